@@ -1,22 +1,48 @@
 package companies
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 )
 
 type CompanyHandler struct {
-	repo CompanyRepository
+	repo     CompanyRepository
+	admins   middleware.AdminChecker
+	auditLog *audit.Recorder
+	// writes without If-Match are answered with 428
+	requireIfMatch bool
 }
 
-func NewCompanyHandler(repo CompanyRepository) *CompanyHandler {
-	return &CompanyHandler{repo: repo}
+func NewCompanyHandler(repo CompanyRepository, admins middleware.AdminChecker, auditLog *audit.Recorder, requireIfMatch bool) *CompanyHandler {
+	return &CompanyHandler{repo: repo, admins: admins, auditLog: auditLog, requireIfMatch: requireIfMatch}
+}
+
+// includeDeleted reads the include_deleted query parameter, only admins may see soft
+// deleted companies. The caller must stop handling the request when ok is false.
+func (h *CompanyHandler) includeDeleted(w http.ResponseWriter, r *http.Request) (includeDeleted bool, ok bool) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return false, true
+	}
+	isAdmin, err := middleware.IsAdmin(r.Context(), h.admins)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error checking admin permission")
+		http.Error(w, "could not check permissions", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return false, false
+	}
+	if !isAdmin {
+		http.Error(w, "include_deleted requires admin permission", http.StatusForbidden)
+		return false, false
+	}
+	return true, true
 }
 
 func (h *CompanyHandler) GetCompanyByID(w http.ResponseWriter, r *http.Request) {
@@ -27,28 +53,38 @@ func (h *CompanyHandler) GetCompanyByID(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	company, err := h.repo.GetByID(context.Background(), id)
+	includeDeleted, ok := h.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	company, err := h.repo.GetByID(r.Context(), id, includeDeleted)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), apis.ErrorStatus(r.Context(), err, http.StatusNotFound))
 		return
 	}
 
+	w.Header().Set("ETag", apis.ETag(company.Version))
+	if apis.NotModified(r.Header.Get("If-None-Match"), company.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(company)
 }
 
 func (h *CompanyHandler) CreateCompany(w http.ResponseWriter, r *http.Request) {
 	var companyReq CompanyRequest
-	err := json.NewDecoder(r.Body).Decode(&companyReq)
+	err := apis.DecodeJSON(r, &companyReq)
 	if err != nil {
-		http.Error(w, "not json", http.StatusBadRequest)
+		http.Error(w, "not json", apis.DecodeErrorStatus(err))
 		return
 	}
 
 	validate := validator.New()
 	if err := validate.Struct(companyReq); err != nil {
 		http.Error(w, "request not in valid format", http.StatusBadRequest)
-		log.Error().Err(err).Msg("request not in valid format")
+		log.Ctx(r.Context()).Error().Err(err).Msg("request not in valid format")
 		return
 	}
 
@@ -57,12 +93,20 @@ func (h *CompanyHandler) CreateCompany(w http.ResponseWriter, r *http.Request) {
 		YearFounded: companyReq.YearFounded,
 	}
 
-	err = h.repo.Create(context.Background(), &company)
+	err = h.repo.Create(r.Context(), &company)
 	if err != nil {
-		log.Error().Err(err)
-		http.Error(w, "Failed to create company", http.StatusInternalServerError)
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to create company")
+		http.Error(w, "Failed to create company", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
 		return
 	}
+	h.auditLog.Record(r.Context(), audit.Event{
+		Action:       audit.ActionCreate,
+		ResourceType: audit.ResourceCompany,
+		ResourceID:   audit.ResourceID(company.ID),
+		Changes:      audit.Diff(nil, company),
+	})
+
+	w.Header().Set("ETag", apis.ETag(company.Version))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(company)
@@ -70,9 +114,14 @@ func (h *CompanyHandler) CreateCompany(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *CompanyHandler) GetCompanies(w http.ResponseWriter, r *http.Request) {
-	companies, err := h.repo.GetAll(context.Background())
+	includeDeleted, ok := h.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	companies, err := h.repo.GetAll(r.Context(), includeDeleted)
 	if err != nil {
-		http.Error(w, "Failed to retrieve companies", http.StatusInternalServerError)
+		http.Error(w, "Failed to retrieve companies", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
 		return
 	}
 
@@ -83,3 +132,99 @@ func (h *CompanyHandler) GetCompanies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (h *CompanyHandler) DeleteCompany(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var reassignTo *int
+	if value := r.URL.Query().Get("reassign_to"); value != "" {
+		target, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid reassign_to", http.StatusBadRequest)
+			return
+		}
+		reassignTo = &target
+	}
+
+	expectedVersions, err := apis.ExpectedVersions(r.Header.Get("If-Match"), h.requireIfMatch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+
+	company, reassigned, err := h.repo.Delete(r.Context(), id, reassignTo, expectedVersions)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrCompanyHasEmployees) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrInvalidReassignTarget) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, apis.ErrPreconditionFailed) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to delete company")
+		http.Error(w, "Failed to delete company", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return
+	}
+	h.auditLog.Record(r.Context(), audit.Event{
+		Action:       audit.ActionDelete,
+		ResourceType: audit.ResourceCompany,
+		ResourceID:   audit.ResourceID(company.ID),
+		Changes:      audit.Diff(nil, map[string]any{"deleted_at": company.DeletedAt}),
+		Metadata:     reassignMetadata(reassignTo, reassigned),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reassignMetadata tells in the audit log where the employees of a deleted company went,
+// their own events are not recorded one by one.
+func reassignMetadata(reassignTo *int, reassigned int64) map[string]string {
+	if reassignTo == nil {
+		return nil
+	}
+	return map[string]string{
+		"reassign_to":          strconv.Itoa(*reassignTo),
+		"reassigned_employees": strconv.FormatInt(reassigned, 10),
+	}
+}
+
+func (h *CompanyHandler) RestoreCompany(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	company, err := h.repo.Restore(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) {
+			http.Error(w, "deleted company not found", http.StatusNotFound)
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to restore company")
+		http.Error(w, "Failed to restore company", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return
+	}
+	h.auditLog.Record(r.Context(), audit.Event{
+		Action:       audit.ActionRestore,
+		ResourceType: audit.ResourceCompany,
+		ResourceID:   audit.ResourceID(company.ID),
+	})
+
+	w.Header().Set("ETag", apis.ETag(company.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(company)
+}
@@ -1,9 +1,17 @@
 package companies
 
+import "time"
+
 type Company struct {
 	ID          int    `json:"id" validate:"required"`
 	Name        string `json:"name" validate:"required"`
 	YearFounded int    `json:"year_founded" validate:"required"`
+	// employees that are not deleted
+	EmployeeCount int `json:"employee_count"`
+	// only set on soft deleted companies, which admins list with include_deleted=true
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// bumped on every change and sent as ETag, employee_count is derived and does not bump it
+	Version int `json:"version"`
 }
 
 type CompanyRequest struct {
@@ -2,16 +2,46 @@ package companies
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/defilippomattia/gorest/apis"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var ErrCompanyNotFound = errors.New("company not found")
+
+var ErrCompanyHasEmployees = errors.New("company still has employees, pass reassign_to to move them to another company")
+
+var ErrInvalidReassignTarget = errors.New("reassign_to must be another company that is not deleted")
+
+// CompanyRepository hides soft deleted companies unless includeDeleted is set.
 type CompanyRepository interface {
-	GetByID(ctx context.Context, id int) (*Company, error)
+	GetByID(ctx context.Context, id int, includeDeleted bool) (*Company, error)
 	Create(ctx context.Context, company *Company) error
-	GetAll(ctx context.Context) ([]Company, error)
+	GetAll(ctx context.Context, includeDeleted bool) ([]Company, error)
+	// Delete marks the company as deleted, Purge removes it for good once the retention passed.
+	// Companies with employees are only deleted when reassignTo names the company they move to.
+	// expectedVersions are the versions from If-Match, nil deletes any version.
+	Delete(ctx context.Context, id int, reassignTo *int, expectedVersions []int) (*Company, int64, error)
+	Restore(ctx context.Context, id int) (*Company, error)
+	Purge(ctx context.Context, olderThan time.Duration) (int64, error)
+}
+
+const companyColumns = `id, name, year_founded, deleted_at, version,
+	(SELECT COUNT(*) FROM employees WHERE employees.company_id = companies.id AND employees.deleted_at IS NULL)`
+
+func scanCompany(row pgx.Row, company *Company) error {
+	return row.Scan(&company.ID, &company.Name, &company.YearFounded, &company.DeletedAt, &company.Version, &company.EmployeeCount)
+}
+
+func notDeletedCondition(includeDeleted bool) string {
+	if includeDeleted {
+		return "TRUE"
+	}
+	return "deleted_at IS NULL"
 }
 
 type PgCompanyRepository struct {
@@ -27,8 +57,8 @@ func (r *PgCompanyRepository) Create(ctx context.Context, company *Company) erro
 		"name":        company.Name,
 		"yearFounded": company.YearFounded,
 	}
-	query := "INSERT INTO companies (name, year_founded) VALUES (@name, @yearFounded) RETURNING id"
-	_, err := r.db.Exec(ctx, query, args)
+	query := "INSERT INTO companies (name, year_founded) VALUES (@name, @yearFounded) RETURNING id, version"
+	err := r.db.QueryRow(ctx, query, args).Scan(&company.ID, &company.Version)
 	if err != nil {
 		return fmt.Errorf("unable to insert row: %w", err)
 	}
@@ -36,19 +66,19 @@ func (r *PgCompanyRepository) Create(ctx context.Context, company *Company) erro
 	return nil
 }
 
-func (r *PgCompanyRepository) GetByID(ctx context.Context, id int) (*Company, error) {
+func (r *PgCompanyRepository) GetByID(ctx context.Context, id int, includeDeleted bool) (*Company, error) {
 	var company Company
-	query := "SELECT id, name, year_founded FROM companies WHERE id = $1"
-	err := r.db.QueryRow(ctx, query, id).Scan(&company.ID, &company.Name, &company.YearFounded)
+	query := "SELECT " + companyColumns + " FROM companies WHERE id = $1 AND " + notDeletedCondition(includeDeleted)
+	err := scanCompany(r.db.QueryRow(ctx, query, id), &company)
 	if err != nil {
 		return nil, fmt.Errorf("could not find company with id %d: %w", id, err)
 	}
 	return &company, nil
 }
 
-func (r *PgCompanyRepository) GetAll(ctx context.Context) ([]Company, error) {
+func (r *PgCompanyRepository) GetAll(ctx context.Context, includeDeleted bool) ([]Company, error) {
 	var companies []Company
-	query := "SELECT id, name, year_founded FROM companies"
+	query := "SELECT " + companyColumns + " FROM companies WHERE " + notDeletedCondition(includeDeleted) + " ORDER BY id"
 	rows, err := r.db.Query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve companies: %w", err)
@@ -57,7 +87,7 @@ func (r *PgCompanyRepository) GetAll(ctx context.Context) ([]Company, error) {
 
 	for rows.Next() {
 		var company Company
-		if err := rows.Scan(&company.ID, &company.Name, &company.YearFounded); err != nil {
+		if err := scanCompany(rows, &company); err != nil {
 			return nil, fmt.Errorf("could not scan company row: %w", err)
 		}
 		companies = append(companies, company)
@@ -69,3 +99,91 @@ func (r *PgCompanyRepository) GetAll(ctx context.Context) ([]Company, error) {
 
 	return companies, nil
 }
+
+func (r *PgCompanyRepository) Delete(ctx context.Context, id int, reassignTo *int, expectedVersions []int) (*Company, int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	//the lock keeps employees from being added while they are moved away
+	var version int
+	err = tx.QueryRow(ctx, "SELECT version FROM companies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&version)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, 0, ErrCompanyNotFound
+		}
+		return nil, 0, fmt.Errorf("unable to lock company: %w", err)
+	}
+	err = apis.CheckVersion(expectedVersions, version)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var reassigned int64
+	if reassignTo != nil {
+		if *reassignTo == id {
+			return nil, 0, ErrInvalidReassignTarget
+		}
+		var exists bool
+		err = tx.QueryRow(ctx, "SELECT TRUE FROM companies WHERE id = $1 AND deleted_at IS NULL FOR SHARE", *reassignTo).Scan(&exists)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return nil, 0, ErrInvalidReassignTarget
+			}
+			return nil, 0, fmt.Errorf("unable to lock company: %w", err)
+		}
+		tag, err := tx.Exec(ctx, "UPDATE employees SET company_id = $1, department_id = NULL, version = version + 1 WHERE company_id = $2 AND deleted_at IS NULL", *reassignTo, id)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to reassign employees: %w", err)
+		}
+		reassigned = tag.RowsAffected()
+	} else {
+		var hasEmployees bool
+		err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM employees WHERE company_id = $1 AND deleted_at IS NULL)", id).Scan(&hasEmployees)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to count employees: %w", err)
+		}
+		if hasEmployees {
+			return nil, 0, ErrCompanyHasEmployees
+		}
+	}
+
+	query := "UPDATE companies SET deleted_at = NOW(), version = version + 1 WHERE id = $1 RETURNING " + companyColumns
+	var company Company
+	err = scanCompany(tx.QueryRow(ctx, query, id), &company)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to delete company: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &company, reassigned, nil
+}
+
+func (r *PgCompanyRepository) Restore(ctx context.Context, id int) (*Company, error) {
+	query := "UPDATE companies SET deleted_at = NULL, version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL RETURNING " + companyColumns
+	var company Company
+	err := scanCompany(r.db.QueryRow(ctx, query, id), &company)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrCompanyNotFound
+		}
+		return nil, fmt.Errorf("unable to restore company: %w", err)
+	}
+	return &company, nil
+}
+
+func (r *PgCompanyRepository) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	//soft deleted employees still point to the company, it waits until they are purged too
+	query := `DELETE FROM companies WHERE deleted_at < NOW() - make_interval(secs => $1)
+		AND NOT EXISTS (SELECT 1 FROM employees WHERE employees.company_id = companies.id)`
+	tag, err := r.db.Exec(ctx, query, olderThan.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge companies: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
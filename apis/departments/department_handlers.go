@@ -0,0 +1,123 @@
+package departments
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+type DepartmentHandler struct {
+	repo     DepartmentRepository
+	auditLog *audit.Recorder
+}
+
+func NewDepartmentHandler(repo DepartmentRepository, auditLog *audit.Recorder) *DepartmentHandler {
+	return &DepartmentHandler{repo: repo, auditLog: auditLog}
+}
+
+func (h *DepartmentHandler) GetDepartments(w http.ResponseWriter, r *http.Request) {
+	companyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	departments, err := h.repo.GetAll(r.Context(), companyID)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to retrieve departments")
+		http.Error(w, "Failed to retrieve departments", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(departments)
+}
+
+func (h *DepartmentHandler) GetDepartmentByID(w http.ResponseWriter, r *http.Request) {
+	companyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "departmentID"))
+	if err != nil {
+		http.Error(w, "Invalid department ID", http.StatusBadRequest)
+		return
+	}
+
+	department, err := h.repo.GetByID(r.Context(), companyID, id)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) || errors.Is(err, ErrDepartmentNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to retrieve department")
+		http.Error(w, "Failed to retrieve department", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(department)
+}
+
+func (h *DepartmentHandler) CreateDepartment(w http.ResponseWriter, r *http.Request) {
+	companyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var departmentReq DepartmentRequest
+	err = apis.DecodeJSON(r, &departmentReq)
+	if err != nil {
+		http.Error(w, "not json", apis.DecodeErrorStatus(err))
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(departmentReq); err != nil {
+		http.Error(w, "request not in valid format", http.StatusBadRequest)
+		log.Ctx(r.Context()).Error().Err(err).Msg("request not in valid format")
+		return
+	}
+
+	department := Department{
+		CompanyID: companyID,
+		Name:      departmentReq.Name,
+	}
+	err = h.repo.Create(r.Context(), &department)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrDepartmentExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to create department")
+		http.Error(w, "Failed to create department", apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		return
+	}
+	h.auditLog.Record(r.Context(), audit.Event{
+		Action:       audit.ActionCreate,
+		ResourceType: audit.ResourceDepartment,
+		ResourceID:   audit.ResourceID(department.ID),
+		Changes:      audit.Diff(nil, department),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(department)
+}
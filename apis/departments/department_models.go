@@ -0,0 +1,16 @@
+package departments
+
+import "time"
+
+type Department struct {
+	ID        int       `json:"id"`
+	CompanyID int       `json:"company_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// employees that are not deleted
+	EmployeeCount int `json:"employee_count"`
+}
+
+type DepartmentRequest struct {
+	Name string `json:"name" validate:"required,max=255"`
+}
@@ -0,0 +1,129 @@
+package departments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrCompanyNotFound = errors.New("company not found")
+
+var ErrDepartmentNotFound = errors.New("department not found")
+
+var ErrDepartmentExists = errors.New("company already has a department with this name")
+
+// DepartmentRepository only serves departments of companies that are not deleted.
+type DepartmentRepository interface {
+	GetAll(ctx context.Context, companyID int) ([]Department, error)
+	GetByID(ctx context.Context, companyID int, id int) (*Department, error)
+	Create(ctx context.Context, department *Department) error
+}
+
+type PgDepartmentRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgDepartmentRepository(db *pgxpool.Pool) *PgDepartmentRepository {
+	return &PgDepartmentRepository{db: db}
+}
+
+const departmentColumns = `id, company_id, name, created_at,
+	(SELECT COUNT(*) FROM employees WHERE employees.department_id = departments.id AND employees.deleted_at IS NULL)`
+
+func scanDepartment(row pgx.Row, department *Department) error {
+	return row.Scan(&department.ID, &department.CompanyID, &department.Name, &department.CreatedAt, &department.EmployeeCount)
+}
+
+func (r *PgDepartmentRepository) companyExists(ctx context.Context, companyID int) error {
+	var exists bool
+	err := r.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM companies WHERE id = $1 AND deleted_at IS NULL)", companyID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("could not check company: %w", err)
+	}
+	if !exists {
+		return ErrCompanyNotFound
+	}
+	return nil
+}
+
+func (r *PgDepartmentRepository) GetAll(ctx context.Context, companyID int) ([]Department, error) {
+	err := r.companyExists(ctx, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + departmentColumns + " FROM departments WHERE company_id = $1 ORDER BY name"
+	rows, err := r.db.Query(ctx, query, companyID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve departments: %w", err)
+	}
+	defer rows.Close()
+
+	departments := []Department{}
+	for rows.Next() {
+		var department Department
+		if err := scanDepartment(rows, &department); err != nil {
+			return nil, fmt.Errorf("could not scan department row: %w", err)
+		}
+		departments = append(departments, department)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during row iteration: %w", err)
+	}
+	return departments, nil
+}
+
+func (r *PgDepartmentRepository) GetByID(ctx context.Context, companyID int, id int) (*Department, error) {
+	err := r.companyExists(ctx, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var department Department
+	query := "SELECT " + departmentColumns + " FROM departments WHERE company_id = $1 AND id = $2"
+	err = scanDepartment(r.db.QueryRow(ctx, query, companyID, id), &department)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrDepartmentNotFound
+		}
+		return nil, fmt.Errorf("could not find department with id %d: %w", id, err)
+	}
+	return &department, nil
+}
+
+func (r *PgDepartmentRepository) Create(ctx context.Context, department *Department) error {
+	args := pgx.NamedArgs{
+		"companyID": department.CompanyID,
+		"name":      department.Name,
+	}
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//deleted companies do not get new departments, the lock makes a concurrent delete wait for the insert
+	var exists int
+	err = tx.QueryRow(ctx, "SELECT 1 FROM companies WHERE id = @companyID AND deleted_at IS NULL FOR SHARE", args).Scan(&exists)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ErrCompanyNotFound
+		}
+		return fmt.Errorf("unable to lock company: %w", err)
+	}
+
+	query := "INSERT INTO departments (company_id, name) VALUES (@companyID, @name) RETURNING id, created_at"
+	err = tx.QueryRow(ctx, query, args).Scan(&department.ID, &department.CreatedAt)
+	if err != nil {
+		pgErr, isPgError := err.(*pgconn.PgError)
+		if isPgError && pgErr.Code == "23505" {
+			return ErrDepartmentExists
+		}
+		return fmt.Errorf("unable to insert department: %w", err)
+	}
+	return tx.Commit(ctx)
+}
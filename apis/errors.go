@@ -0,0 +1,38 @@
+package apis
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// StatusClientClosedRequest is the non standard status (nginx convention) used when
+// the client went away before the response was ready. It only shows up in logs and metrics.
+const StatusClientClosedRequest = 499
+
+// ErrorStatus maps errors caused by a cancelled or timed out request context to
+// 499 and 503 respectively, any other error gets the fallback status.
+func ErrorStatus(ctx context.Context, err error, fallback int) int {
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// HumaError is ErrorStatus for huma handlers, errors not caused by the request
+// context are returned unchanged.
+func HumaError(ctx context.Context, err error) error {
+	status := ErrorStatus(ctx, err, http.StatusInternalServerError)
+	switch status {
+	case StatusClientClosedRequest:
+		return huma.NewError(status, "client closed request")
+	case http.StatusServiceUnavailable:
+		return huma.NewError(status, "request timed out")
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package apis
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrPreconditionFailed is answered with 412, the resource changed since the client read it.
+var ErrPreconditionFailed = errors.New("resource was changed by someone else, fetch it again and retry")
+
+// ErrPreconditionRequired is answered with 428 when writes must carry an If-Match header.
+var ErrPreconditionRequired = errors.New("If-Match header with the ETag of the resource is required")
+
+// ETag is the entity tag of a resource version, versions are bumped on every change.
+func ETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ExpectedVersions reads the If-Match header of a write. Nil means the write is not
+// conditional, either the header is missing or it is *. Tags that are not our versions,
+// like weak ones which If-Match never matches, end up as an empty list that no
+// version matches.
+func ExpectedVersions(ifMatch string, required bool) ([]int, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" {
+		if required {
+			return nil, ErrPreconditionRequired
+		}
+		return nil, nil
+	}
+	if ifMatch == "*" {
+		return nil, nil
+	}
+
+	versions := []int{}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		version, ok := parseETag(strings.TrimSpace(tag))
+		if ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// CheckVersion fails with ErrPreconditionFailed when the current version of the resource
+// is not one the client expects.
+func CheckVersion(expected []int, version int) error {
+	if expected != nil && !slices.Contains(expected, version) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// NotModified reports whether the If-None-Match header of a read matches the version,
+// the client then gets 304 instead of the resource. Reads compare weak tags too.
+func NotModified(ifNoneMatch string, version int) bool {
+	ifNoneMatch = strings.TrimSpace(ifNoneMatch)
+	if ifNoneMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tagVersion, ok := parseETag(strings.TrimPrefix(strings.TrimSpace(tag), "W/"))
+		if ok && tagVersion == version {
+			return true
+		}
+	}
+	return false
+}
+
+func parseETag(tag string) (int, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(tag[1 : len(tag)-1])
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,41 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+var ErrTrailingData = errors.New("request body must contain a single json value")
+
+// DecodeJSON decodes the request body into v, rejecting fields v does not have and
+// anything after the first json value. Huma handlers get the same from the schema.
+func DecodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	_, err = decoder.Token()
+	if err != io.EOF {
+		//the limit may be hit while looking for trailing data, that is still a too large body
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// DecodeErrorStatus returns 413 when DecodeJSON failed because the body exceeded
+// the limit set by middleware.BodyLimit, 400 otherwise.
+func DecodeErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
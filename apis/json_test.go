@@ -0,0 +1,60 @@
+package apis
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		Name string `json:"name"`
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		limit      int64
+		wantErr    error
+		wantStatus int
+	}{
+		{name: "single value", body: `{"name": "a"}`},
+		{name: "trailing whitespace", body: "{\"name\": \"a\"}\n\t "},
+		{name: "trailing value", body: `{"name": "a"} {"name": "b"}`, wantErr: ErrTrailingData, wantStatus: http.StatusBadRequest},
+		{name: "trailing garbage", body: `{"name": "a"} x`, wantErr: ErrTrailingData, wantStatus: http.StatusBadRequest},
+		{name: "unknown field", body: `{"name": "a", "admin": true}`, wantStatus: http.StatusBadRequest},
+		{name: "value over the limit", body: `{"name": "` + strings.Repeat("a", 64) + `"}`, limit: 32, wantStatus: http.StatusRequestEntityTooLarge},
+		//the value fits, the limit is hit while looking for trailing data
+		{name: "trailing data over the limit", body: `{"name": "a"}` + strings.Repeat(" ", 64) + "x", limit: 32, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			if test.limit > 0 {
+				req.Body = http.MaxBytesReader(httptest.NewRecorder(), req.Body, test.limit)
+			}
+			var v request
+			err := DecodeJSON(req, &v)
+			if test.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("DecodeJSON() error = %v", err)
+				}
+				if v.Name != "a" {
+					t.Errorf("decoded name = %q, want a", v.Name)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("DecodeJSON() error = nil")
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("DecodeJSON() error = %v, want %v", err, test.wantErr)
+			}
+			if got := DecodeErrorStatus(err); got != test.wantStatus {
+				t.Errorf("DecodeErrorStatus(%v) = %d, want %d", err, got, test.wantStatus)
+			}
+		})
+	}
+}
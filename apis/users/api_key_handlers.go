@@ -0,0 +1,127 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+type APIKeyHandler struct {
+	repo APIKeyRepository
+}
+
+func NewAPIKeyHandler(repo APIKeyRepository) *APIKeyHandler {
+	return &APIKeyHandler{repo: repo}
+}
+
+func writeAPIKeyError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIKeyErrorResponse{
+		ResponseType: "error",
+		Message:      message,
+	})
+}
+
+// rejectAPIKeyAuth keeps a leaked key from minting new keys or revoking the owner's other keys,
+// the caller must stop handling the request when it returns true.
+func rejectAPIKeyAuth(w http.ResponseWriter, r *http.Request) bool {
+	if middleware.GetAuthMethod(r.Context()) != middleware.AuthMethodAPIKey {
+		return false
+	}
+	log.Ctx(r.Context()).Warn().Msg("api key management called with an api key")
+	writeAPIKeyError(w, http.StatusForbidden, "forbidden - api keys can not manage api keys")
+	return true
+}
+
+func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if rejectAPIKeyAuth(w, r) {
+		return
+	}
+
+	var createReq APIKeyCreateRequest
+	err := apis.DecodeJSON(r, &createReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode createReq")
+		writeAPIKeyError(w, apis.DecodeErrorStatus(err), "invalid request - name and scopes must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(createReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeAPIKeyError(w, http.StatusBadRequest, "invalid request - name and scopes (read, write) must be provided")
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	key, apiKey, err := h.repo.Create(r.Context(), userID, &createReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error creating api key")
+		writeAPIKeyError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not create api key")
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Int("user_id", userID).
+		Int("api_key_id", apiKey.ID).
+		Str("prefix", apiKey.Prefix).
+		Msg("api key created")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyCreateSuccessResponse{
+		ResponseType: "success",
+		Message:      "api key created, store it now as it will not be shown again",
+		Key:          key,
+		APIKey:       *apiKey,
+	})
+}
+
+func (h *APIKeyHandler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	apiKeys, err := h.repo.GetAll(r.Context(), middleware.GetUserID(r.Context()))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error retrieving api keys")
+		writeAPIKeyError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not retrieve api keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+func (h *APIKeyHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if rejectAPIKeyAuth(w, r) {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIKeyError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	err = h.repo.Revoke(r.Context(), userID, id)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			writeAPIKeyError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("error revoking api key")
+		writeAPIKeyError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not revoke api key")
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Int("user_id", userID).Int("api_key_id", id).Msg("api key revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package users
+
+import "time"
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type APIKeyCreateRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+	// middleware.ScopeRead and/or middleware.ScopeWrite
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=read write"`
+	// the key never expires when empty
+	ExpiresInDays int `json:"expires_in_days" validate:"gte=0,lte=3650"`
+}
+
+type APIKeyCreateSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+	// only returned once, the server keeps a hash of it
+	Key    string `json:"key" validate:"required"`
+	APIKey APIKey `json:"api_key" validate:"required"`
+}
+
+type APIKeyErrorResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
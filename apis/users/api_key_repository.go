@@ -0,0 +1,132 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidAPIKey = errors.New("api key is invalid, expired or revoked")
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type APIKeyRepository interface {
+	// Create returns the new key in plain text, it can not be retrieved later
+	Create(ctx context.Context, userID int, req *APIKeyCreateRequest) (string, *APIKey, error)
+	GetAll(ctx context.Context, userID int) ([]APIKey, error)
+	Revoke(ctx context.Context, userID int, id int) error
+	// ValidateAPIKey also records the key as used
+	ValidateAPIKey(ctx context.Context, key string) (int, []string, error)
+}
+
+type PgAPIKeyRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgAPIKeyRepository(db *pgxpool.Pool) *PgAPIKeyRepository {
+	return &PgAPIKeyRepository{db: db}
+}
+
+const apiKeyColumns = "id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at"
+
+func scanAPIKey(row pgx.Row, apiKey *APIKey) error {
+	return row.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreatedAt, &apiKey.ExpiresAt, &apiKey.LastUsedAt, &apiKey.RevokedAt)
+}
+
+func (r *PgAPIKeyRepository) Create(ctx context.Context, userID int, req *APIKeyCreateRequest) (string, *APIKey, error) {
+	key, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to generate api key: %w", err)
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		expiry := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	args := pgx.NamedArgs{
+		"userID":    userID,
+		"name":      req.Name,
+		"prefix":    prefix,
+		"keyHash":   auth.HashToken(key),
+		"scopes":    req.Scopes,
+		"expiresAt": expiresAt,
+	}
+	query := "INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at) VALUES (@userID, @name, @prefix, @keyHash, @scopes, @expiresAt) RETURNING " + apiKeyColumns
+
+	var apiKey APIKey
+	err = scanAPIKey(r.db.QueryRow(ctx, query, args), &apiKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to insert api key: %w", err)
+	}
+	return key, &apiKey, nil
+}
+
+func (r *PgAPIKeyRepository) GetAll(ctx context.Context, userID int) ([]APIKey, error) {
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+	query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE user_id = @userID ORDER BY id"
+	rows, err := r.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve api keys: %w", err)
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		var apiKey APIKey
+		if err := scanAPIKey(rows, &apiKey); err != nil {
+			return nil, fmt.Errorf("could not scan api key row: %w", err)
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during row iteration: %w", err)
+	}
+
+	return apiKeys, nil
+}
+
+func (r *PgAPIKeyRepository) Revoke(ctx context.Context, userID int, id int) error {
+	args := pgx.NamedArgs{
+		"id":     id,
+		"userID": userID,
+	}
+	query := "UPDATE api_keys SET revoked_at = NOW() WHERE id = @id AND user_id = @userID AND revoked_at IS NULL"
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return fmt.Errorf("unable to revoke api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (r *PgAPIKeyRepository) ValidateAPIKey(ctx context.Context, key string) (int, []string, error) {
+	args := pgx.NamedArgs{
+		"keyHash": auth.HashToken(key),
+	}
+	query := `UPDATE api_keys SET last_used_at = NOW()
+		WHERE key_hash = @keyHash AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING user_id, scopes`
+
+	var userID int
+	var scopes []string
+	err := r.db.QueryRow(ctx, query, args).Scan(&userID, &scopes)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, nil, ErrInvalidAPIKey
+		}
+		return -1, nil, fmt.Errorf("unable to validate api key: %w", err)
+	}
+	return userID, scopes, nil
+}
@@ -0,0 +1,166 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/mailer"
+	"github.com/defilippomattia/gorest/ratelimit"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// EmailVerification holds what the email verification flow needs. URL is the link in the
+// mail, usually GET /api/users/verify of this API. Login is refused for users without a
+// verified email when Required is set.
+type EmailVerification struct {
+	Repo     EmailVerificationRepository
+	Mailer   mailer.Mailer
+	Queue    *mailer.Queue
+	TokenTTL time.Duration
+	URL      string
+	Required bool
+	// one verification mail per email address per MinInterval, further requests are answered alike but send nothing
+	MinInterval time.Duration
+	Throttle    ratelimit.Store
+}
+
+func (v *EmailVerification) throttled(ctx context.Context, email string) bool {
+	return emailThrottled(ctx, v.Throttle, "email_verification", email, v.ThrottlePolicy())
+}
+
+// ThrottlePolicy allows one verification mail per email address and MinInterval.
+func (v *EmailVerification) ThrottlePolicy() ratelimit.Policy {
+	return ratelimit.Policy{Requests: 1, Period: v.MinInterval, Burst: 1}
+}
+
+// queueVerificationMail mails a verification link to the email unless the email got one moments ago.
+func (h *UserHandler) queueVerificationMail(ctx context.Context, userID int, email string) {
+	if h.emailVerification.throttled(ctx, email) {
+		log.Ctx(ctx).Info().Msg("verification mail requested again too soon, no mail sent")
+		return
+	}
+	enqueueMail(ctx, h.emailVerification.Queue, func(ctx context.Context) {
+		h.sendVerificationMail(ctx, userID, email)
+	})
+}
+
+// ErrEmailNotVerified is only returned after the password was verified, so it does not
+// reveal anything about accounts the client has no access to.
+var ErrEmailNotVerified = errors.New("email address is not verified")
+
+func (h *UserHandler) sendVerificationMail(ctx context.Context, userID int, email string) {
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+
+	verificationToken, err := h.emailVerification.Repo.Create(ctx, userID, email, h.emailVerification.TokenTTL, h.emailVerification.MinInterval)
+	if errors.Is(err, ErrVerificationThrottled) {
+		log.Ctx(ctx).Info().Int("user_id", userID).Msg("verification mail requested again too soon, no mail sent")
+		return
+	}
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("user_id", userID).Msg("error creating verification token")
+		return
+	}
+
+	err = h.emailVerification.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Open the link below to verify your email address, it is valid for " + h.emailVerification.TokenTTL.String() + ":\n" +
+			tokenLink(h.emailVerification.URL, verificationToken) + "\n\n" +
+			"If you did not create an account, ignore this mail.\n",
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("user_id", userID).Msg("error sending verification mail")
+		return
+	}
+
+	log.Ctx(ctx).Info().Int("user_id", userID).Msg("verification mail sent")
+}
+
+func (h *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	verificationToken := r.URL.Query().Get("token")
+	if verificationToken == "" {
+		writeUserError(w, http.StatusBadRequest, "invalid request - token must be provided")
+		return
+	}
+
+	userID, err := h.emailVerification.Repo.Verify(r.Context(), verificationToken)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not verify email"
+		if errors.Is(err, ErrInvalidVerificationToken) {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		//only the owner of the mailbox has the token, telling it does not reveal the account
+		if errors.Is(err, ErrEmailInUse) {
+			status = http.StatusConflict
+			message = err.Error()
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("error verifying email")
+		writeUserError(w, status, message)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.email_verified").
+		Int("user_id", userID).
+		Msg("email verified")
+	h.recordUserUpdated(r.Context(), userID, audit.Diff(
+		map[string]bool{"email_verified": false},
+		map[string]bool{"email_verified": true},
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EmailVerificationSuccessResponse{
+		ResponseType: "success",
+		Message:      "email verified",
+	})
+}
+
+func (h *UserHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var resendReq EmailVerificationResendRequest
+
+	err := apis.DecodeJSON(r, &resendReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode resendReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - username and email must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(resendReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - username and email must be provided")
+		return
+	}
+
+	//several users may claim an unverified email, the mail is only about the account of the caller
+	user, err := h.repo.GetByUsername(r.Context(), resendReq.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not send verification mail")
+		return
+	}
+	//same answer for unknown users, other emails and already verified emails, see RequestPasswordReset
+	if user != nil && !user.EmailVerified && strings.EqualFold(user.EmailAddress(), resendReq.Email) {
+		h.queueVerificationMail(r.Context(), user.ID, *user.Email)
+	} else if h.emailVerification.throttled(r.Context(), resendReq.Email) {
+		//takes from the bucket like a known email, so both answer alike
+		log.Ctx(r.Context()).Info().Msg("verification mail requested again too soon, no mail sent")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(EmailVerificationSuccessResponse{
+		ResponseType: "success",
+		Message:      "if the email of the account is not verified yet, a verification link was sent to it",
+	})
+}
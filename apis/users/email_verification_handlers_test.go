@@ -0,0 +1,101 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/defilippomattia/gorest/mailer"
+	"github.com/defilippomattia/gorest/ratelimit"
+)
+
+// memoryUserRepository implements the lookups of UserRepository the mail flows use.
+type memoryUserRepository struct {
+	UserRepository
+
+	users []User
+}
+
+func (r *memoryUserRepository) GetByUsername(ctx context.Context, username string) (*User, error) {
+	for i := range r.users {
+		if r.users[i].Username == username {
+			return &r.users[i], nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// recordingVerificationRepository remembers the users tokens were created for.
+type recordingVerificationRepository struct {
+	EmailVerificationRepository
+
+	mu      sync.Mutex
+	userIDs []int
+}
+
+func (r *recordingVerificationRepository) Create(ctx context.Context, userID int, email string, ttl time.Duration, minInterval time.Duration) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.userIDs = append(r.userIDs, userID)
+	return "token", nil
+}
+
+func (r *recordingVerificationRepository) created() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.userIDs...)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestResendVerificationOnlyMailsTheCallersAccount(t *testing.T) {
+	verificationRepo := &recordingVerificationRepository{}
+	queue := mailer.NewQueue(1, 10)
+	h := &UserHandler{
+		repo: &memoryUserRepository{users: []User{
+			{ID: 1, Username: "owner", Email: stringPtr("shared@example.com")},
+			{ID: 2, Username: "squatter", Email: stringPtr("shared@example.com")},
+			{ID: 3, Username: "verified", Email: stringPtr("verified@example.com"), EmailVerified: true},
+		}},
+		emailVerification: &EmailVerification{
+			Repo:        verificationRepo,
+			Mailer:      mailer.NewLogMailer(),
+			Queue:       queue,
+			URL:         "http://localhost/api/users/verify",
+			MinInterval: time.Hour,
+			Throttle:    ratelimit.NewMemoryStore(),
+		},
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "own unverified email", body: `{"username": "owner", "email": "Shared@example.com"}`},
+		{name: "throttled", body: `{"username": "owner", "email": "shared@example.com"}`},
+		{name: "email of another account", body: `{"username": "verified", "email": "other@example.com"}`},
+		{name: "already verified", body: `{"username": "verified", "email": "verified@example.com"}`},
+		{name: "unknown user", body: `{"username": "nobody", "email": "nobody@example.com"}`},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ResendVerification(rec, httptest.NewRequest(http.MethodPost, "/api/users/verify/resend", strings.NewReader(test.body)))
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, http.StatusAccepted)
+		}
+	}
+
+	//the single worker runs the jobs in order, once this one ran the others did
+	drained := make(chan struct{})
+	queue.Enqueue(func() { close(drained) })
+	<-drained
+	if got := verificationRepo.created(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("tokens created for users %v, want [1]", got)
+	}
+}
@@ -0,0 +1,115 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidVerificationToken = errors.New("verification token is invalid, expired or already used")
+
+var ErrVerificationThrottled = errors.New("a verification token was created for the user moments ago")
+
+type EmailVerificationRepository interface {
+	// Create returns the new token for the email in plain text, only its hash is stored. It
+	// fails with ErrVerificationThrottled when the user got a token less than minInterval ago.
+	Create(ctx context.Context, userID int, email string, ttl time.Duration, minInterval time.Duration) (string, error)
+	// Verify consumes the token and marks the email of its user as verified, other users
+	// lose their unverified claim to the email. It fails with ErrEmailInUse when another
+	// user verified the email first.
+	Verify(ctx context.Context, verificationToken string) (int, error)
+}
+
+type PgEmailVerificationRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgEmailVerificationRepository(db *pgxpool.Pool) *PgEmailVerificationRepository {
+	return &PgEmailVerificationRepository{db: db}
+}
+
+func (r *PgEmailVerificationRepository) Create(ctx context.Context, userID int, email string, ttl time.Duration, minInterval time.Duration) (string, error) {
+	verificationToken, err := auth.GenerateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate verification token: %w", err)
+	}
+
+	args := pgx.NamedArgs{
+		"tokenHash":   auth.HashToken(verificationToken),
+		"userID":      userID,
+		"email":       email,
+		"ttl":         ttl.Seconds(),
+		"minInterval": minInterval.Seconds(),
+	}
+	//the handler throttles per instance, this holds across instances
+	query := `INSERT INTO email_verification_tokens (token_hash, user_id, email, expires_at)
+		SELECT @tokenHash, @userID, @email, NOW() + make_interval(secs => @ttl)
+		WHERE NOT EXISTS (SELECT 1 FROM email_verification_tokens
+			WHERE user_id = @userID AND created_at > NOW() - make_interval(secs => @minInterval))`
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return "", fmt.Errorf("unable to insert verification token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrVerificationThrottled
+	}
+	return verificationToken, nil
+}
+
+func (r *PgEmailVerificationRepository) Verify(ctx context.Context, verificationToken string) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(ctx)
+
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(verificationToken),
+	}
+	query := `UPDATE email_verification_tokens SET used_at = NOW()
+		WHERE token_hash = @tokenHash AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, email`
+	var userID int
+	var email string
+	err = tx.QueryRow(ctx, query, args).Scan(&userID, &email)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, ErrInvalidVerificationToken
+		}
+		return -1, err
+	}
+
+	userArgs := pgx.NamedArgs{
+		"userID": userID,
+		"email":  email,
+	}
+	tag, err := tx.Exec(ctx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = @userID AND email = @email", userArgs)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "users_email_idx" {
+			return -1, ErrEmailInUse
+		}
+		return -1, fmt.Errorf("unable to mark email as verified: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		//the user changed the email after the token was sent
+		return -1, ErrInvalidVerificationToken
+	}
+	//the address belongs to this user now, nobody else may keep squatting it
+	_, err = tx.Exec(ctx, "UPDATE users SET email = NULL WHERE LOWER(email) = LOWER(@email) AND id <> @userID AND email_verified_at IS NULL", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to release other claims of the email: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return userID, nil
+}
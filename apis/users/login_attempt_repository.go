@@ -0,0 +1,87 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	scopeUsername = "username"
+	scopeIP       = "ip"
+)
+
+type LoginAttemptRepository interface {
+	IsLocked(ctx context.Context, scope string, key string) (bool, error)
+	RecordFailure(ctx context.Context, scope string, key string, window time.Duration) (int, error)
+	Lock(ctx context.Context, scope string, key string, lockout time.Duration) error
+	Reset(ctx context.Context, scope string, key string) error
+}
+
+type PgLoginAttemptRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgLoginAttemptRepository(db *pgxpool.Pool) *PgLoginAttemptRepository {
+	return &PgLoginAttemptRepository{db: db}
+}
+
+func (r *PgLoginAttemptRepository) IsLocked(ctx context.Context, scope string, key string) (bool, error) {
+	args := pgx.NamedArgs{
+		"scope": scope,
+		"key":   key,
+	}
+	query := "SELECT EXISTS (SELECT 1 FROM login_attempts WHERE scope = @scope AND key = @key AND locked_until > NOW())"
+	var locked bool
+	err := r.db.QueryRow(ctx, query, args).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+// RecordFailure increments the failure counter and returns its new value,
+// the counter starts over when the previous failure is older than window.
+func (r *PgLoginAttemptRepository) RecordFailure(ctx context.Context, scope string, key string, window time.Duration) (int, error) {
+	args := pgx.NamedArgs{
+		"scope":  scope,
+		"key":    key,
+		"window": window.Seconds(),
+	}
+	query := `INSERT INTO login_attempts (scope, key, failures, last_failure_at) VALUES (@scope, @key, 1, NOW())
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => @window) THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures`
+	var failures int
+	err := r.db.QueryRow(ctx, query, args).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return failures, nil
+}
+
+// Lock blocks logins for the key and resets its failure counter, so progressive
+// delays start over once the lockout expires.
+func (r *PgLoginAttemptRepository) Lock(ctx context.Context, scope string, key string, lockout time.Duration) error {
+	args := pgx.NamedArgs{
+		"scope":   scope,
+		"key":     key,
+		"lockout": lockout.Seconds(),
+	}
+	query := "UPDATE login_attempts SET failures = 0, locked_until = NOW() + make_interval(secs => @lockout) WHERE scope = @scope AND key = @key"
+	_, err := r.db.Exec(ctx, query, args)
+	return err
+}
+
+func (r *PgLoginAttemptRepository) Reset(ctx context.Context, scope string, key string) error {
+	args := pgx.NamedArgs{
+		"scope": scope,
+		"key":   key,
+	}
+	query := "DELETE FROM login_attempts WHERE scope = @scope AND key = @key"
+	_, err := r.db.Exec(ctx, query, args)
+	return err
+}
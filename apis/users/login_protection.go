@@ -0,0 +1,107 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type LoginProtectionPolicy struct {
+	MaxFailures   int
+	IPMaxFailures int
+	FailureWindow time.Duration
+	Lockout       time.Duration
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+}
+
+// LoginProtection tracks failed logins per username and per ip, slows down
+// repeated failures and temporarily locks the username or ip once a threshold is reached.
+type LoginProtection struct {
+	repo   LoginAttemptRepository
+	policy LoginProtectionPolicy
+}
+
+func NewLoginProtection(repo LoginAttemptRepository, policy LoginProtectionPolicy) *LoginProtection {
+	return &LoginProtection{repo: repo, policy: policy}
+}
+
+func (p *LoginProtection) IsLocked(ctx context.Context, username string, ip string) (bool, error) {
+	if p.policy.MaxFailures > 0 {
+		locked, err := p.repo.IsLocked(ctx, scopeUsername, username)
+		if err != nil || locked {
+			return locked, err
+		}
+	}
+	if p.policy.IPMaxFailures > 0 {
+		return p.repo.IsLocked(ctx, scopeIP, ip)
+	}
+	return false, nil
+}
+
+// RecordFailure counts a failed login and returns how long to wait before answering it.
+func (p *LoginProtection) RecordFailure(ctx context.Context, username string, ip string) (time.Duration, error) {
+	userFailures, err := p.recordFailure(ctx, scopeUsername, username, p.policy.MaxFailures)
+	if err != nil {
+		return 0, err
+	}
+	ipFailures, err := p.recordFailure(ctx, scopeIP, ip, p.policy.IPMaxFailures)
+	if err != nil {
+		return 0, err
+	}
+	return p.delay(max(userFailures, ipFailures)), nil
+}
+
+func (p *LoginProtection) recordFailure(ctx context.Context, scope string, key string, maxFailures int) (int, error) {
+	failures, err := p.repo.RecordFailure(ctx, scope, key, p.policy.FailureWindow)
+	if err != nil {
+		return 0, err
+	}
+	if maxFailures > 0 && failures >= maxFailures {
+		err = p.repo.Lock(ctx, scope, key, p.policy.Lockout)
+		if err != nil {
+			return 0, err
+		}
+		log.Ctx(ctx).Warn().
+			Str("event", "auth.lockout").
+			Str("scope", scope).
+			Str(scope, key).
+			Int("failures", failures).
+			Dur("lockout", p.policy.Lockout).
+			Msg("too many failed logins, locking")
+	}
+	return failures, nil
+}
+
+// delay doubles with every consecutive failure, starting at BaseDelay and capped at MaxDelay.
+func (p *LoginProtection) delay(failures int) time.Duration {
+	if failures <= 0 || p.policy.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.policy.BaseDelay
+	for i := 1; i < failures && delay < p.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.policy.MaxDelay)
+}
+
+// RecordSuccess forgets the failures of the username. Failures of the ip are kept so
+// logging into an own account can not be used to keep guessing passwords of others.
+func (p *LoginProtection) RecordSuccess(ctx context.Context, username string) error {
+	return p.repo.Reset(ctx, scopeUsername, username)
+}
+
+// Unlock lifts the lockout of a username and/or ip, empty values are skipped.
+func (p *LoginProtection) Unlock(ctx context.Context, username string, ip string) error {
+	if username != "" {
+		err := p.repo.Reset(ctx, scopeUsername, username)
+		if err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return p.repo.Reset(ctx, scopeIP, ip)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package users
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/defilippomattia/gorest/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// how long the user may take to log in at the provider
+const oidcStateTTL = 10 * time.Minute
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCProvider is one configured identity provider. Identities without a linked user
+// get a new user when AutoCreateUsers is set, otherwise they must be linked first by
+// starting the login while logged in.
+type OIDCProvider struct {
+	Client          *oidc.Provider
+	AutoCreateUsers bool
+}
+
+type OIDCHandler struct {
+	repo      OIDCRepository
+	providers map[string]OIDCProvider
+	// issues the session exactly like a password login
+	users *UserHandler
+}
+
+func NewOIDCHandler(repo OIDCRepository, providers map[string]OIDCProvider, users *UserHandler) *OIDCHandler {
+	return &OIDCHandler{repo: repo, providers: providers, users: users}
+}
+
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	provider, ok := h.providers[providerName]
+	if !ok {
+		writeUserError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+
+	state, err := oidc.GenerateCodeVerifier()
+	if err != nil {
+		writeUserError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+	nonce, err := oidc.GenerateCodeVerifier()
+	if err != nil {
+		writeUserError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+	codeVerifier, err := oidc.GenerateCodeVerifier()
+	if err != nil {
+		writeUserError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+
+	loginState := &OIDCLoginState{CodeVerifier: codeVerifier, Nonce: nonce}
+	//only sessions link identities, a leaked api key or access token must not attach a foreign identity
+	if middleware.GetAuthMethod(r.Context()) == middleware.AuthMethodSession {
+		userID := middleware.GetUserID(r.Context())
+		loginState.LinkUserID = &userID
+	}
+
+	authURL, err := provider.Client.AuthCodeURL(r.Context(), state, nonce, codeVerifier)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("provider", providerName).Msg("error building authorization url")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusBadGateway), "identity provider is not available")
+		return
+	}
+
+	err = h.repo.CreateState(r.Context(), providerName, state, loginState, oidcStateTTL)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error storing oidc login state")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not start login")
+		return
+	}
+
+	//binds the callback to the browser that started the login
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	provider, ok := h.providers[providerName]
+	if !ok {
+		writeUserError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc/", MaxAge: -1})
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		log.Ctx(r.Context()).Warn().
+			Str("provider", providerName).
+			Str("error", providerError).
+			Str("error_description", query.Get("error_description")).
+			Msg("identity provider refused login")
+		writeUserError(w, http.StatusUnauthorized, "identity provider refused login")
+		return
+	}
+
+	state := query.Get("state")
+	code := query.Get("code")
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || code == "" || err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		writeUserError(w, http.StatusBadRequest, ErrInvalidOIDCState.Error())
+		return
+	}
+
+	loginState, err := h.repo.ConsumeState(r.Context(), providerName, state)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not log in"
+		if errors.Is(err, ErrInvalidOIDCState) {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	claims, err := provider.Client.Exchange(r.Context(), code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		metrics.FailedLoginsTotal.Inc()
+		log.Ctx(r.Context()).Error().Err(err).Str("provider", providerName).Msg("error exchanging authorization code")
+		status := apis.ErrorStatus(r.Context(), err, http.StatusBadGateway)
+		if errors.Is(err, oidc.ErrInvalidIDToken) {
+			status = http.StatusUnauthorized
+			h.users.recordFailedLogin(r.Context(), -1, "", failedLoginInvalidIDToken)
+		}
+		writeUserError(w, status, "could not log in with the identity provider")
+		return
+	}
+
+	userID, err := h.resolveUser(r, providerName, provider, claims, loginState)
+	if hashingBusy(w, r, err) {
+		return
+	}
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not log in"
+		if errors.Is(err, ErrIdentityNotLinked) || errors.Is(err, ErrIdentityLinkedElsewhere) {
+			status = http.StatusForbidden
+			message = err.Error()
+		}
+		log.Ctx(r.Context()).Error().Err(err).Str("provider", providerName).Msg("error resolving user of oidc identity")
+		writeUserError(w, status, message)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.oidc_login").
+		Str("provider", providerName).
+		Int("user_id", userID).
+		Msg("user logged in with identity provider")
+
+	//the provider already authenticated the user, local second factors and email verification do not apply
+	h.users.completeLogin(w, r, userID, AuthModeCookie)
+}
+
+// resolveUser returns the user linked to the identity, linking or creating one when allowed.
+func (h *OIDCHandler) resolveUser(r *http.Request, providerName string, provider OIDCProvider, claims *oidc.Claims, loginState *OIDCLoginState) (int, error) {
+	userID, err := h.repo.FindUser(r.Context(), providerName, claims.Subject)
+	if err == nil {
+		if loginState.LinkUserID != nil && *loginState.LinkUserID != userID {
+			return -1, ErrIdentityLinkedElsewhere
+		}
+		return userID, nil
+	}
+	if !errors.Is(err, ErrIdentityNotLinked) {
+		return -1, err
+	}
+
+	if loginState.LinkUserID != nil {
+		err = h.repo.Link(r.Context(), providerName, claims.Subject, *loginState.LinkUserID, claims.Email)
+		if err != nil {
+			return -1, err
+		}
+		log.Ctx(r.Context()).Info().
+			Str("event", "auth.oidc_linked").
+			Str("provider", providerName).
+			Int("user_id", *loginState.LinkUserID).
+			Msg("external identity linked")
+		h.users.recordUserUpdated(r.Context(), *loginState.LinkUserID, audit.Diff(nil, map[string]string{
+			"oidc_identity": providerName + ":" + claims.Subject,
+		}))
+		return *loginState.LinkUserID, nil
+	}
+
+	if !provider.AutoCreateUsers {
+		return -1, ErrIdentityNotLinked
+	}
+
+	//usernames are free to register, so the preferred one may be taken by someone else
+	fallbackUsername := providerName + ":" + claims.Subject
+	username := claims.PreferredUsername
+	if username == "" {
+		username = fallbackUsername
+	}
+	userID, err = h.repo.CreateUser(r.Context(), providerName, claims.Subject, username, claims.Email)
+	if errors.Is(err, ErrUsernameTaken) && username != fallbackUsername {
+		userID, err = h.repo.CreateUser(r.Context(), providerName, claims.Subject, fallbackUsername, claims.Email)
+	}
+	if err != nil {
+		return -1, err
+	}
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.oidc_user_created").
+		Str("provider", providerName).
+		Int("user_id", userID).
+		Msg("user created for external identity")
+	created := auditedUser{Username: username}
+	if claims.Email != "" {
+		created.Email = &claims.Email
+	}
+	h.users.recordUserCreated(r.Context(), userID, created)
+	return userID, nil
+}
@@ -0,0 +1,172 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidOIDCState = errors.New("login state is invalid or expired")
+
+var ErrIdentityNotLinked = errors.New("external identity is not linked to a user")
+
+var ErrIdentityLinkedElsewhere = errors.New("external identity is already linked to another user")
+
+// OIDCLoginState is kept between the redirect to the provider and the callback.
+// LinkUserID is set when a logged in user started the flow to link the identity.
+type OIDCLoginState struct {
+	CodeVerifier string
+	Nonce        string
+	LinkUserID   *int
+}
+
+type OIDCRepository interface {
+	CreateState(ctx context.Context, provider string, state string, loginState *OIDCLoginState, ttl time.Duration) error
+	// ConsumeState returns and deletes the state, it can only be used once
+	ConsumeState(ctx context.Context, provider string, state string) (*OIDCLoginState, error)
+	FindUser(ctx context.Context, provider string, subject string) (int, error)
+	Link(ctx context.Context, provider string, subject string, userID int, email string) error
+	// CreateUser creates a user without usable password and links the identity to it
+	CreateUser(ctx context.Context, provider string, subject string, username string, email string) (int, error)
+}
+
+type PgOIDCRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgOIDCRepository(db *pgxpool.Pool) *PgOIDCRepository {
+	return &PgOIDCRepository{db: db}
+}
+
+func (r *PgOIDCRepository) CreateState(ctx context.Context, provider string, state string, loginState *OIDCLoginState, ttl time.Duration) error {
+	args := pgx.NamedArgs{
+		"stateHash":    auth.HashToken(state),
+		"provider":     provider,
+		"codeVerifier": loginState.CodeVerifier,
+		"nonce":        loginState.Nonce,
+		"linkUserID":   loginState.LinkUserID,
+		"ttl":          ttl.Seconds(),
+	}
+	query := `INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, link_user_id, expires_at)
+		VALUES (@stateHash, @provider, @codeVerifier, @nonce, @linkUserID, NOW() + make_interval(secs => @ttl))`
+	_, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return fmt.Errorf("unable to insert oidc login state: %w", err)
+	}
+
+	//nothing else removes states of abandoned logins
+	_, err = r.db.Exec(ctx, "DELETE FROM oidc_login_states WHERE expires_at < NOW()")
+	if err != nil {
+		return fmt.Errorf("unable to delete expired oidc login states: %w", err)
+	}
+	return nil
+}
+
+func (r *PgOIDCRepository) ConsumeState(ctx context.Context, provider string, state string) (*OIDCLoginState, error) {
+	args := pgx.NamedArgs{
+		"stateHash": auth.HashToken(state),
+		"provider":  provider,
+	}
+	query := `DELETE FROM oidc_login_states
+		WHERE state_hash = @stateHash AND provider = @provider AND expires_at > NOW()
+		RETURNING code_verifier, nonce, link_user_id`
+	var loginState OIDCLoginState
+	err := r.db.QueryRow(ctx, query, args).Scan(&loginState.CodeVerifier, &loginState.Nonce, &loginState.LinkUserID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrInvalidOIDCState
+		}
+		return nil, err
+	}
+	return &loginState, nil
+}
+
+func (r *PgOIDCRepository) FindUser(ctx context.Context, provider string, subject string) (int, error) {
+	args := pgx.NamedArgs{
+		"provider": provider,
+		"subject":  subject,
+	}
+	query := "UPDATE oidc_identities SET last_login_at = NOW() WHERE provider = @provider AND subject = @subject RETURNING user_id"
+	var userID int
+	err := r.db.QueryRow(ctx, query, args).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, ErrIdentityNotLinked
+		}
+		return -1, err
+	}
+	return userID, nil
+}
+
+func (r *PgOIDCRepository) Link(ctx context.Context, provider string, subject string, userID int, email string) error {
+	return r.link(ctx, r.db, provider, subject, userID, email)
+}
+
+func (r *PgOIDCRepository) link(ctx context.Context, db execer, provider string, subject string, userID int, email string) error {
+	args := pgx.NamedArgs{
+		"provider": provider,
+		"subject":  subject,
+		"userID":   userID,
+		"email":    email,
+	}
+	query := "INSERT INTO oidc_identities (provider, subject, user_id, email, last_login_at) VALUES (@provider, @subject, @userID, @email, NOW())"
+	_, err := db.Exec(ctx, query, args)
+	if err != nil {
+		pgErr, isPgError := err.(*pgconn.PgError)
+		if isPgError && pgErr.Code == "23505" {
+			return ErrIdentityLinkedElsewhere
+		}
+		return fmt.Errorf("unable to link oidc identity: %w", err)
+	}
+	return nil
+}
+
+func (r *PgOIDCRepository) CreateUser(ctx context.Context, provider string, subject string, username string, email string) (int, error) {
+	//a random password nobody knows keeps the password login closed for this user
+	randomPassword, err := auth.GenerateSessionToken()
+	if err != nil {
+		return -1, err
+	}
+	hashedPassword, err := auth.HashPassword(ctx, randomPassword)
+	if err != nil {
+		return -1, err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(ctx)
+
+	args := pgx.NamedArgs{
+		"username": username,
+		"password": hashedPassword,
+	}
+	query := "INSERT INTO users (username, password) VALUES (@username, @password) RETURNING id"
+	var userID int
+	err = tx.QueryRow(ctx, query, args).Scan(&userID)
+	if err != nil {
+		pgErr, isPgError := err.(*pgconn.PgError)
+		if isPgError && pgErr.Code == "23505" {
+			return -1, ErrUsernameTaken
+		}
+		return -1, fmt.Errorf("unable to insert user: %w", err)
+	}
+
+	err = r.link(ctx, tx, provider, subject, userID, email)
+	if err != nil {
+		return -1, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,230 @@
+package users
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/mailer"
+	"github.com/defilippomattia/gorest/ratelimit"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// mails are sent after the response, this bounds how long a slow mail server may take
+const mailTimeout = 30 * time.Second
+
+// enqueueMail runs send on the mail queue after the response, a full queue drops the mail.
+func enqueueMail(ctx context.Context, queue *mailer.Queue, send func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	if !queue.Enqueue(func() { send(ctx) }) {
+		log.Ctx(ctx).Error().Msg("mail queue is full, mail dropped")
+	}
+}
+
+// emailThrottled takes the request of the email from its bucket. Unknown emails take one
+// too, so known and unknown emails still answer alike.
+func emailThrottled(ctx context.Context, store ratelimit.Store, flow string, email string, policy ratelimit.Policy) bool {
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	result, err := store.Take(ctx, flow+"|"+hex.EncodeToString(sum[:]), policy)
+	if err != nil {
+		//the token repositories throttle as well
+		log.Ctx(ctx).Error().Err(err).Str("flow", flow).Msg("error checking mail throttle")
+		return false
+	}
+	return !result.Allowed
+}
+
+// PasswordReset holds what the password reset flow needs. URL is the frontend page
+// that asks for the new password, the mailed link appends the token to it.
+type PasswordReset struct {
+	Repo     PasswordResetRepository
+	Mailer   mailer.Mailer
+	Queue    *mailer.Queue
+	TokenTTL time.Duration
+	URL      string
+	// one reset mail per email address per MinInterval, further requests are answered alike but send nothing
+	MinInterval time.Duration
+	Throttle    ratelimit.Store
+}
+
+func (p *PasswordReset) throttled(ctx context.Context, email string) bool {
+	return emailThrottled(ctx, p.Throttle, "password_reset", email, p.ThrottlePolicy())
+}
+
+// ThrottlePolicy allows one reset request per email address and MinInterval.
+func (p *PasswordReset) ThrottlePolicy() ratelimit.Policy {
+	return ratelimit.Policy{Requests: 1, Period: p.MinInterval, Burst: 1}
+}
+
+// RequestPasswordReset mails a reset link to the email if an account verified it. Unknown and
+// unverified emails get the same answer and no mail.
+func (h *UserHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var resetReq PasswordResetRequest
+
+	err := apis.DecodeJSON(r, &resetReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode resetReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - email must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(resetReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - email must be provided")
+		return
+	}
+
+	user, err := h.repo.GetByEmail(r.Context(), resetReq.Email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not request password reset")
+		return
+	}
+	if h.passwordReset.throttled(r.Context(), resetReq.Email) {
+		log.Ctx(r.Context()).Info().Msg("password reset requested again too soon, no mail sent")
+	} else if user != nil && user.EmailVerified {
+		//the token is created and mailed after the response, so unknown and known emails answer alike and equally fast
+		userID, email := user.ID, *user.Email
+		enqueueMail(r.Context(), h.passwordReset.Queue, func(ctx context.Context) {
+			h.sendPasswordResetMail(ctx, userID, email)
+		})
+	} else {
+		//an unverified email may be claimed by anyone, the mailbox owner must not get a reset link of someone else's account
+		log.Ctx(r.Context()).Info().Msg("password reset requested for unknown or unverified email")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PasswordResetSuccessResponse{
+		ResponseType: "success",
+		Message:      "if the email belongs to an account and is verified, a reset link was sent to it",
+	})
+}
+
+func (h *UserHandler) sendPasswordResetMail(ctx context.Context, userID int, email string) {
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+
+	resetToken, err := h.passwordReset.Repo.Create(ctx, userID, h.passwordReset.TokenTTL, h.passwordReset.MinInterval)
+	if errors.Is(err, ErrResetThrottled) {
+		log.Ctx(ctx).Info().Int("user_id", userID).Msg("password reset requested again too soon, no mail sent")
+		return
+	}
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("user_id", userID).Msg("error creating password reset token")
+		return
+	}
+
+	err = h.passwordReset.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Someone requested a password reset for your account.\n\n" +
+			"Open the link below to choose a new password, it is valid for " + h.passwordReset.TokenTTL.String() + ":\n" +
+			tokenLink(h.passwordReset.URL, resetToken) + "\n\n" +
+			"If you did not request it, ignore this mail.\n",
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("user_id", userID).Msg("error sending password reset mail")
+		return
+	}
+
+	log.Ctx(ctx).Info().
+		Str("event", "auth.password_reset_requested").
+		Int("user_id", userID).
+		Msg("password reset mail sent")
+}
+
+// tokenLink appends the token to a link from the config as ?token=.
+func tokenLink(link string, token string) string {
+	//the link is validated by the config
+	linkURL, _ := url.Parse(link)
+	query := linkURL.Query()
+	query.Set("token", token)
+	linkURL.RawQuery = query.Encode()
+	return linkURL.String()
+}
+
+func (h *UserHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var confirmReq PasswordResetConfirmRequest
+
+	err := apis.DecodeJSON(r, &confirmReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode confirmReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - token and new_password must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(confirmReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - token and new_password must be provided")
+		return
+	}
+
+	userID, err := h.passwordReset.Repo.Lookup(r.Context(), confirmReq.Token)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not reset password"
+		if errors.Is(err, ErrInvalidResetToken) {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	user, err := h.repo.GetByID(r.Context(), userID)
+	if err != nil {
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not reset password")
+		return
+	}
+
+	if h.rejectPassword(w, r, confirmReq.NewPassword, user.Username, user.EmailAddress()) {
+		return
+	}
+
+	_, err = h.passwordReset.Repo.Reset(r.Context(), confirmReq.Token, confirmReq.NewPassword)
+	if hashingBusy(w, r, err) {
+		return
+	}
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not reset password"
+		if errors.Is(err, ErrInvalidResetToken) {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("error resetting password")
+		writeUserError(w, status, message)
+		return
+	}
+
+	//the owner proved control of the email, a lockout caused by someone guessing the password is lifted
+	err = h.loginProtection.RecordSuccess(r.Context(), user.Username)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error resetting failed logins")
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.password_reset").
+		Int("user_id", userID).
+		Msg("password reset, all sessions, refresh tokens and api keys revoked")
+	h.recordUserUpdated(r.Context(), userID, audit.Redacted("password"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasswordResetSuccessResponse{
+		ResponseType: "success",
+		Message:      "password reset, log in with the new password",
+	})
+}
@@ -0,0 +1,139 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidResetToken = errors.New("password reset token is invalid, expired or already used")
+
+var ErrResetThrottled = errors.New("a password reset token was created for the user moments ago")
+
+type PasswordResetRepository interface {
+	// Create returns the new token in plain text, only its hash is stored. It fails with
+	// ErrResetThrottled when the user got a token less than minInterval ago.
+	Create(ctx context.Context, userID int, ttl time.Duration, minInterval time.Duration) (string, error)
+	// Lookup returns the user of a token that can still be used
+	Lookup(ctx context.Context, resetToken string) (int, error)
+	// Reset consumes the token, sets the new password and revokes all sessions, refresh tokens and api keys of the user
+	Reset(ctx context.Context, resetToken string, newPassword string) (int, error)
+}
+
+type PgPasswordResetRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgPasswordResetRepository(db *pgxpool.Pool) *PgPasswordResetRepository {
+	return &PgPasswordResetRepository{db: db}
+}
+
+func (r *PgPasswordResetRepository) Create(ctx context.Context, userID int, ttl time.Duration, minInterval time.Duration) (string, error) {
+	resetToken, err := auth.GenerateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate password reset token: %w", err)
+	}
+
+	args := pgx.NamedArgs{
+		"tokenHash":   auth.HashToken(resetToken),
+		"userID":      userID,
+		"ttl":         ttl.Seconds(),
+		"minInterval": minInterval.Seconds(),
+	}
+	//the handler throttles per instance, this holds across instances
+	query := `INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		SELECT @tokenHash, @userID, NOW() + make_interval(secs => @ttl)
+		WHERE NOT EXISTS (SELECT 1 FROM password_reset_tokens
+			WHERE user_id = @userID AND created_at > NOW() - make_interval(secs => @minInterval))`
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return "", fmt.Errorf("unable to insert password reset token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrResetThrottled
+	}
+	return resetToken, nil
+}
+
+func (r *PgPasswordResetRepository) Lookup(ctx context.Context, resetToken string) (int, error) {
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(resetToken),
+	}
+	query := "SELECT user_id FROM password_reset_tokens WHERE token_hash = @tokenHash AND used_at IS NULL AND expires_at > NOW()"
+	var userID int
+	err := r.db.QueryRow(ctx, query, args).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, ErrInvalidResetToken
+		}
+		return -1, err
+	}
+	return userID, nil
+}
+
+func (r *PgPasswordResetRepository) Reset(ctx context.Context, resetToken string, newPassword string) (int, error) {
+	//hash before the transaction, argon2 may wait for a free slot
+	hashedPassword, err := auth.HashPassword(ctx, newPassword)
+	if err != nil {
+		return -1, err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(ctx)
+
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(resetToken),
+	}
+	query := `UPDATE password_reset_tokens SET used_at = NOW()
+		WHERE token_hash = @tokenHash AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`
+	var userID int
+	err = tx.QueryRow(ctx, query, args).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, ErrInvalidResetToken
+		}
+		return -1, err
+	}
+
+	userArgs := pgx.NamedArgs{
+		"userID":   userID,
+		"password": hashedPassword,
+	}
+	_, err = tx.Exec(ctx, "UPDATE users SET password = @password WHERE id = @userID", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to update password: %w", err)
+	}
+	//other tokens that were requested in the meantime must not reset the password again
+	_, err = tx.Exec(ctx, "UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = @userID AND used_at IS NULL", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to invalidate password reset tokens: %w", err)
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM sessions WHERE user_id = @userID", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to revoke sessions: %w", err)
+	}
+	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = @userID AND revoked_at IS NULL", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to revoke refresh tokens: %w", err)
+	}
+	//api keys act for the user without a password, whoever took over the account may have created some
+	_, err = tx.Exec(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE user_id = @userID AND revoked_at IS NULL", userArgs)
+	if err != nil {
+		return -1, fmt.Errorf("unable to revoke api keys: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return userID, nil
+}
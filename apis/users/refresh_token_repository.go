@@ -0,0 +1,130 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+
+// ErrRefreshTokenReuse means an already rotated token was presented again, so it probably
+// leaked. The whole token family is revoked when this happens.
+var ErrRefreshTokenReuse = errors.New("refresh token was already used")
+
+type RefreshTokenRepository interface {
+	// Create starts a new token family for the user and returns the first token of it
+	Create(ctx context.Context, userID int, ttl time.Duration) (string, error)
+	// Rotate consumes the token and returns its user with the next token of the family
+	Rotate(ctx context.Context, refreshToken string, ttl time.Duration) (int, string, error)
+}
+
+type PgRefreshTokenRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgRefreshTokenRepository(db *pgxpool.Pool) *PgRefreshTokenRepository {
+	return &PgRefreshTokenRepository{db: db}
+}
+
+func (r *PgRefreshTokenRepository) Create(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	return r.insert(ctx, r.db, userID, uuid.New(), ttl)
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+func (r *PgRefreshTokenRepository) insert(ctx context.Context, db execer, userID int, familyID uuid.UUID, ttl time.Duration) (string, error) {
+	refreshToken, err := auth.GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(refreshToken),
+		"userID":    userID,
+		"familyID":  familyID,
+		"ttl":       ttl.Seconds(),
+	}
+	query := "INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at) VALUES (@tokenHash, @userID, @familyID, NOW() + make_interval(secs => @ttl))"
+	_, err = db.Exec(ctx, query, args)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func (r *PgRefreshTokenRepository) Rotate(ctx context.Context, refreshToken string, ttl time.Duration) (int, string, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return -1, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	var familyID uuid.UUID
+	var expired bool
+	var usedAt, revokedAt *time.Time
+
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(refreshToken),
+	}
+	query := "SELECT user_id, family_id, expires_at < NOW(), used_at, revoked_at FROM refresh_tokens WHERE token_hash = @tokenHash FOR UPDATE"
+	err = tx.QueryRow(ctx, query, args).Scan(&userID, &familyID, &expired, &usedAt, &revokedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			log.Ctx(ctx).Error().Msg("refresh token not found")
+			return -1, "", ErrInvalidRefreshToken
+		}
+		return -1, "", err
+	}
+
+	if usedAt != nil {
+		revokeArgs := pgx.NamedArgs{
+			"familyID": familyID,
+		}
+		_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = @familyID AND revoked_at IS NULL", revokeArgs)
+		if err != nil {
+			return -1, "", err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return -1, "", err
+		}
+		log.Ctx(ctx).Warn().
+			Str("event", "auth.refresh_token_reuse").
+			Int("user_id", userID).
+			Str("family_id", familyID.String()).
+			Msg("refresh token reused, revoking token family")
+		return -1, "", ErrRefreshTokenReuse
+	}
+
+	if revokedAt != nil || expired {
+		log.Ctx(ctx).Error().Int("user_id", userID).Msg("refresh token revoked or expired")
+		return -1, "", ErrInvalidRefreshToken
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = @tokenHash", args)
+	if err != nil {
+		return -1, "", err
+	}
+
+	nextToken, err := r.insert(ctx, tx, userID, familyID, ttl)
+	if err != nil {
+		return -1, "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, "", err
+	}
+	return userID, nextToken, nil
+}
@@ -0,0 +1,134 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// newTestDatabase loads schemas/init.sql into a schema of its own on the database of
+// GOREST_TEST_DATABASE_URL, the test is skipped without it.
+func newTestDatabase(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	connUrl := os.Getenv("GOREST_TEST_DATABASE_URL")
+	if connUrl == "" {
+		t.Skip("GOREST_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("gorest_test_%d", time.Now().UnixNano())
+
+	admin, err := pgx.Connect(ctx, connUrl)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	defer admin.Close(ctx)
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+	if err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), connUrl)
+		if err != nil {
+			return
+		}
+		defer conn.Close(context.Background())
+		conn.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	poolConfig, err := pgxpool.ParseConfig(connUrl)
+	if err != nil {
+		t.Fatalf("parsing GOREST_TEST_DATABASE_URL: %v", err)
+	}
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema
+	db, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	initSQL, err := os.ReadFile("../../schemas/init.sql")
+	if err != nil {
+		t.Fatalf("reading init.sql: %v", err)
+	}
+	_, err = db.Exec(ctx, string(initSQL), pgx.QueryExecModeSimpleProtocol)
+	if err != nil {
+		t.Fatalf("loading init.sql: %v", err)
+	}
+	return db
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	repo := NewPgRefreshTokenRepository(db)
+
+	var userID int
+	err := db.QueryRow(ctx, "INSERT INTO users (username, password) VALUES ('alice', 'x') RETURNING id").Scan(&userID)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	first, err := repo.Create(ctx, userID, time.Hour)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	gotUserID, second, err := repo.Rotate(ctx, first, time.Hour)
+	if err != nil || gotUserID != userID {
+		t.Fatalf("Rotate() = %d, %v, want %d, nil", gotUserID, err, userID)
+	}
+	_, third, err := repo.Rotate(ctx, second, time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate() of the second token error = %v", err)
+	}
+	other, err := repo.Create(ctx, userID, time.Hour)
+	if err != nil {
+		t.Fatalf("Create() of another family error = %v", err)
+	}
+
+	//the first token was already rotated, presenting it again means it leaked
+	_, _, err = repo.Rotate(ctx, first, time.Hour)
+	if !errors.Is(err, ErrRefreshTokenReuse) {
+		t.Fatalf("Rotate() of a used token error = %v, want %v", err, ErrRefreshTokenReuse)
+	}
+	//the latest token of the family is revoked with it
+	_, _, err = repo.Rotate(ctx, third, time.Hour)
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Rotate() of the latest token of the family error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	//other families of the user, e.g. another device, are not affected
+	_, _, err = repo.Rotate(ctx, other, time.Hour)
+	if err != nil {
+		t.Errorf("Rotate() of another family error = %v", err)
+	}
+}
+
+func TestRefreshTokenRejectsUnknownAndExpired(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	repo := NewPgRefreshTokenRepository(db)
+
+	var userID int
+	err := db.QueryRow(ctx, "INSERT INTO users (username, password) VALUES ('alice', 'x') RETURNING id").Scan(&userID)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	_, _, err = repo.Rotate(ctx, "unknown", time.Hour)
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Rotate() of an unknown token error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	expired, err := repo.Create(ctx, userID, -time.Minute)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	_, _, err = repo.Rotate(ctx, expired, time.Hour)
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Rotate() of an expired token error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
@@ -0,0 +1,112 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// TokenAuth holds what the token auth mode needs: short lived signed access tokens
+// and opaque refresh tokens that are rotated on every use.
+type TokenAuth struct {
+	Issuer          *auth.TokenIssuer
+	RefreshTokens   RefreshTokenRepository
+	RefreshTokenTTL time.Duration
+}
+
+// issueTokens answers with a new access token and a refresh token. An empty refreshToken
+// starts a new token family, otherwise refreshToken is rotated.
+func (h *UserHandler) issueTokens(w http.ResponseWriter, r *http.Request, userID int, refreshToken string) {
+	var err error
+	isLogin := refreshToken == ""
+	if isLogin {
+		refreshToken, err = h.tokenAuth.RefreshTokens.Create(r.Context(), userID, h.tokenAuth.RefreshTokenTTL)
+	} else {
+		userID, refreshToken, err = h.tokenAuth.RefreshTokens.Rotate(r.Context(), refreshToken, h.tokenAuth.RefreshTokenTTL)
+	}
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not issue tokens"
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReuse) {
+			status = http.StatusUnauthorized
+			message = err.Error()
+		}
+		log.Ctx(r.Context()).Error().Err(err).Msg("error issuing refresh token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      message,
+		})
+		return
+	}
+
+	accessToken, expiresAt, err := h.tokenAuth.Issuer.IssueAccessToken(userID)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error signing access token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not issue tokens",
+		})
+		return
+	}
+
+	if isLogin {
+		metrics.LoginsTotal.Inc()
+		h.recordAuthEvent(r.Context(), audit.ActionLogin, userID, map[string]string{"auth_mode": AuthModeToken})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expiresAt).Seconds()),
+		RefreshToken: refreshToken,
+	})
+}
+
+func (h *UserHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	if h.tokenAuth == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var refreshReq RefreshTokenRequest
+
+	err := apis.DecodeJSON(r, &refreshReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode refreshReq")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.DecodeErrorStatus(err))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "invalid request - refresh_token must be provided",
+		})
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(refreshReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "invalid request - refresh_token must be provided",
+		})
+		return
+	}
+
+	h.issueTokens(w, r, -1, refreshReq.RefreshToken)
+}
@@ -0,0 +1,380 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+const recoveryCodeCount = 10
+
+// TwoFactor holds what TOTP two-factor authentication needs. Issuer is the account
+// name shown by authenticator apps, a login challenge expires after ChallengeTTL
+// or MaxAttempts wrong codes.
+type TwoFactor struct {
+	Repo         TwoFactorRepository
+	Issuer       string
+	ChallengeTTL time.Duration
+	MaxAttempts  int
+}
+
+// rejectTwoFactorAPIKeyAuth keeps api keys from changing the second factor of their owner,
+// the caller must stop handling the request when it returns true.
+func rejectTwoFactorAPIKeyAuth(w http.ResponseWriter, r *http.Request) bool {
+	if middleware.GetAuthMethod(r.Context()) != middleware.AuthMethodAPIKey {
+		return false
+	}
+	log.Ctx(r.Context()).Warn().Msg("two-factor management called with an api key")
+	writeUserError(w, http.StatusForbidden, "forbidden - api keys can not manage two-factor authentication")
+	return true
+}
+
+// startTwoFactorLogin answers a login whose password was verified with a challenge
+// token instead of a session.
+func (h *UserHandler) startTwoFactorLogin(w http.ResponseWriter, r *http.Request, userID int, authMode string) {
+	mfaToken, err := h.twoFactor.Repo.CreateChallenge(r.Context(), userID, authMode, h.twoFactor.ChallengeTTL)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error creating mfa challenge")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log in")
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.two_factor_challenge").
+		Int("user_id", userID).
+		Msg("password verified, waiting for second factor")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TwoFactorRequiredResponse{
+		ResponseType: "two_factor_required",
+		Message:      "second factor required",
+		MFAToken:     mfaToken,
+		ExpiresIn:    int(h.twoFactor.ChallengeTTL.Seconds()),
+	})
+}
+
+// verifySecondFactor checks a TOTP code, rejecting codes that were already used,
+// or consumes a recovery code.
+func (h *UserHandler) verifySecondFactor(ctx context.Context, userID int, codeReq *TwoFactorCodeRequest) error {
+	if codeReq.RecoveryCode != "" {
+		codeHash := auth.HashToken(auth.NormalizeRecoveryCode(codeReq.RecoveryCode))
+		used, err := h.twoFactor.Repo.UseRecoveryCode(ctx, userID, codeHash)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidTwoFactorCode
+		}
+		log.Ctx(ctx).Info().
+			Str("event", "auth.recovery_code_used").
+			Int("user_id", userID).
+			Msg("recovery code used")
+		return nil
+	}
+
+	secret, enabled, err := h.twoFactor.Repo.GetSecret(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+	step, ok := auth.ValidateTOTP(secret, codeReq.Code, time.Now())
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	fresh, err := h.twoFactor.Repo.UseStep(ctx, userID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		log.Ctx(ctx).Warn().Int("user_id", userID).Msg("totp code replayed")
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+func (h *UserHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var loginReq TwoFactorLoginRequest
+
+	err := apis.DecodeJSON(r, &loginReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode loginReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - mfa_token and code or recovery_code must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(loginReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - mfa_token and code or recovery_code must be provided")
+		return
+	}
+
+	userID, authMode, err := h.twoFactor.Repo.CheckChallenge(r.Context(), loginReq.MFAToken, h.twoFactor.MaxAttempts)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not log in"
+		if errors.Is(err, ErrInvalidMFAToken) {
+			metrics.FailedLoginsTotal.Inc()
+			status = http.StatusUnauthorized
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	user, err := h.repo.GetByID(r.Context(), userID)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error fetching user of mfa challenge")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log in")
+		return
+	}
+
+	//a lockout that started after the password step also stops the second one
+	clientIP := middleware.ClientIP(r)
+	locked, err := h.loginProtection.IsLocked(r.Context(), user.Username, clientIP)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error checking login lockout")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log in")
+		return
+	}
+	if locked {
+		metrics.FailedLoginsTotal.Inc()
+		writeUserError(w, http.StatusUnauthorized, ErrInvalidTwoFactorCode.Error())
+		return
+	}
+
+	err = h.verifySecondFactor(r.Context(), userID, &loginReq.TwoFactorCodeRequest)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidTwoFactorCode) {
+			log.Ctx(r.Context()).Error().Err(err).Msg("error verifying second factor")
+			writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log in")
+			return
+		}
+		//wrong codes count towards the same lockout as wrong passwords
+		metrics.FailedLoginsTotal.Inc()
+		log.Ctx(r.Context()).Warn().
+			Str("event", "auth.two_factor_failed").
+			Int("user_id", userID).
+			Str("ip", clientIP).
+			Msg("wrong second factor")
+		h.recordFailedLogin(r.Context(), userID, user.Username, failedLoginInvalidSecondFactor)
+		h.delayFailedLogin(r, user.Username, clientIP)
+		writeUserError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = h.twoFactor.Repo.DeleteChallenge(r.Context(), loginReq.MFAToken)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error deleting mfa challenge")
+	}
+	err = h.loginProtection.RecordSuccess(r.Context(), user.Username)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error resetting failed logins")
+	}
+
+	h.completeLogin(w, r, userID, authMode)
+}
+
+func (h *UserHandler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if rejectTwoFactorAPIKeyAuth(w, r) {
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	user, err := h.repo.GetByID(r.Context(), userID)
+	if err != nil {
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not enroll two-factor authentication")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error generating totp secret")
+		writeUserError(w, http.StatusInternalServerError, "could not enroll two-factor authentication")
+		return
+	}
+
+	err = h.twoFactor.Repo.SetPendingSecret(r.Context(), userID, secret)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not enroll two-factor authentication"
+		if errors.Is(err, ErrTwoFactorAlreadyEnabled) {
+			status = http.StatusConflict
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Int("user_id", userID).Msg("two-factor enrollment started")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TwoFactorEnrollResponse{
+		ResponseType:    "success",
+		Message:         "scan the provisioning uri and confirm with a code",
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(h.twoFactor.Issuer, user.Username, secret),
+	})
+}
+
+func (h *UserHandler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if rejectTwoFactorAPIKeyAuth(w, r) {
+		return
+	}
+
+	var confirmReq TwoFactorConfirmRequest
+
+	err := apis.DecodeJSON(r, &confirmReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode confirmReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - a 6 digit code must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(confirmReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - a 6 digit code must be provided")
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	secret, enabled, err := h.twoFactor.Repo.GetSecret(r.Context(), userID)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not confirm two-factor authentication"
+		if errors.Is(err, ErrTwoFactorNotEnrolled) {
+			status = http.StatusConflict
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+	if enabled {
+		writeUserError(w, http.StatusConflict, ErrTwoFactorAlreadyEnabled.Error())
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(secret, confirmReq.Code, time.Now())
+	if !ok {
+		writeUserError(w, http.StatusBadRequest, ErrInvalidTwoFactorCode.Error())
+		return
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error generating recovery codes")
+		writeUserError(w, http.StatusInternalServerError, "could not confirm two-factor authentication")
+		return
+	}
+	recoveryCodeHashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		recoveryCodeHashes = append(recoveryCodeHashes, auth.HashToken(code))
+	}
+
+	err = h.twoFactor.Repo.Enable(r.Context(), userID, step, recoveryCodeHashes)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not confirm two-factor authentication"
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.two_factor_enabled").
+		Int("user_id", userID).
+		Msg("two-factor authentication enabled")
+	h.recordUserUpdated(r.Context(), userID, audit.Diff(
+		map[string]bool{"two_factor_enabled": false},
+		map[string]bool{"two_factor_enabled": true},
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TwoFactorConfirmResponse{
+		ResponseType:  "success",
+		Message:       "two-factor authentication enabled",
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+func (h *UserHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if rejectTwoFactorAPIKeyAuth(w, r) {
+		return
+	}
+
+	var codeReq TwoFactorCodeRequest
+
+	err := apis.DecodeJSON(r, &codeReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode codeReq")
+		writeUserError(w, apis.DecodeErrorStatus(err), "invalid request - code or recovery_code must be provided")
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(codeReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		writeUserError(w, http.StatusBadRequest, "invalid request - code or recovery_code must be provided")
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	err = h.verifySecondFactor(r.Context(), userID, &codeReq)
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not disable two-factor authentication"
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			status = http.StatusForbidden
+			message = err.Error()
+		} else if errors.Is(err, ErrTwoFactorNotEnrolled) {
+			status = http.StatusConflict
+			message = err.Error()
+		}
+		writeUserError(w, status, message)
+		return
+	}
+
+	err = h.twoFactor.Repo.Disable(r.Context(), userID)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error disabling two-factor authentication")
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not disable two-factor authentication")
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.two_factor_disabled").
+		Int("user_id", userID).
+		Msg("two-factor authentication disabled")
+	h.recordUserUpdated(r.Context(), userID, audit.Diff(
+		map[string]bool{"two_factor_enabled": true},
+		map[string]bool{"two_factor_enabled": false},
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorSuccessResponse{
+		ResponseType: "success",
+		Message:      "two-factor authentication disabled",
+	})
+}
@@ -0,0 +1,113 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+)
+
+// memoryTwoFactorRepository implements the parts of TwoFactorRepository a second factor check uses.
+type memoryTwoFactorRepository struct {
+	TwoFactorRepository
+
+	mu            sync.Mutex
+	secret        string
+	lastUsedStep  int64
+	recoveryCodes map[string]bool
+}
+
+func (r *memoryTwoFactorRepository) GetSecret(ctx context.Context, userID int) (string, bool, error) {
+	return r.secret, true, nil
+}
+
+func (r *memoryTwoFactorRepository) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastUsedStep >= step {
+		return false, nil
+	}
+	r.lastUsedStep = step
+	return true, nil
+}
+
+func (r *memoryTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unused, ok := r.recoveryCodes[codeHash]
+	if !ok || !unused {
+		return false, nil
+	}
+	r.recoveryCodes[codeHash] = false
+	return true, nil
+}
+
+// totpCodeAt computes the code of an authenticator app, RFC 6238 with SHA1 and 6 digits.
+func totpCodeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decoding secret: %v", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestVerifySecondFactorRejectsReplayedSteps(t *testing.T) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generating secret: %v", err)
+	}
+	repo := &memoryTwoFactorRepository{secret: secret}
+	h := &UserHandler{twoFactor: &TwoFactor{Repo: repo}}
+	ctx := context.Background()
+	now := time.Now()
+
+	err = h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{Code: totpCodeAt(t, secret, now)})
+	if err != nil {
+		t.Fatalf("fresh code rejected: %v", err)
+	}
+	err = h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{Code: totpCodeAt(t, secret, now)})
+	if !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("replayed code = %v, want %v", err, ErrInvalidTwoFactorCode)
+	}
+	//the previous step is inside the window but older than the used one
+	err = h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{Code: totpCodeAt(t, secret, now.Add(-30*time.Second))})
+	if !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("code of an earlier step = %v, want %v", err, ErrInvalidTwoFactorCode)
+	}
+	err = h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{Code: totpCodeAt(t, secret, now.Add(30*time.Second))})
+	if err != nil {
+		t.Errorf("code of the next step rejected: %v", err)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodesAreSingleUse(t *testing.T) {
+	repo := &memoryTwoFactorRepository{recoveryCodes: map[string]bool{
+		auth.HashToken("abcde-fghij"): true,
+	}}
+	h := &UserHandler{twoFactor: &TwoFactor{Repo: repo}}
+	ctx := context.Background()
+
+	err := h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{RecoveryCode: "ABCDEFGHIJ"})
+	if err != nil {
+		t.Fatalf("recovery code rejected: %v", err)
+	}
+	err = h.verifySecondFactor(ctx, 1, &TwoFactorCodeRequest{RecoveryCode: "abcde-fghij"})
+	if !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("reused recovery code = %v, want %v", err, ErrInvalidTwoFactorCode)
+	}
+}
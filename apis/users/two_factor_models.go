@@ -0,0 +1,45 @@
+package users
+
+type TwoFactorEnrollResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+	Secret       string `json:"secret" validate:"required"`
+	// otpauth:// uri to render as QR code for authenticator apps
+	ProvisioningURI string `json:"provisioning_uri" validate:"required"`
+}
+
+type TwoFactorConfirmRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type TwoFactorConfirmResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+	// shown only once, every code can be used once instead of a TOTP code
+	RecoveryCodes []string `json:"recovery_codes" validate:"required"`
+}
+
+// TwoFactorCodeRequest takes either a TOTP code or a recovery code.
+type TwoFactorCodeRequest struct {
+	Code         string `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode string `json:"recovery_code" validate:"required_without=Code"`
+}
+
+type TwoFactorLoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	TwoFactorCodeRequest
+}
+
+// TwoFactorRequiredResponse answers a login with a correct password when the user has
+// two-factor authentication enabled, the login is completed with POST /api/users/login/2fa.
+type TwoFactorRequiredResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	ExpiresIn    int    `json:"expires_in" validate:"required"`
+}
+
+type TwoFactorSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
@@ -0,0 +1,231 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not enrolled")
+
+var ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+
+var ErrInvalidTwoFactorCode = errors.New("two-factor code is invalid")
+
+// ErrInvalidMFAToken covers unknown, expired and exhausted login challenges alike.
+var ErrInvalidMFAToken = errors.New("mfa token is invalid or expired")
+
+type TwoFactorRepository interface {
+	IsEnabled(ctx context.Context, userID int) (bool, error)
+	// SetPendingSecret starts or restarts an enrollment, the secret is not used for login until Enable
+	SetPendingSecret(ctx context.Context, userID int, secret string) error
+	GetSecret(ctx context.Context, userID int) (string, bool, error)
+	// UseStep records the TOTP step as used and returns false when it or a later one was used before
+	UseStep(ctx context.Context, userID int, step int64) (bool, error)
+	// Enable replaces all recovery codes of the user with the given hashes
+	Enable(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error
+	Disable(ctx context.Context, userID int) error
+	// UseRecoveryCode marks the code as used and returns false when it does not exist or was used
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	// CreateChallenge returns the token that links the password step of a login to the second factor
+	CreateChallenge(ctx context.Context, userID int, authMode string, ttl time.Duration) (string, error)
+	// CheckChallenge counts an attempt on the challenge and returns its user and auth mode
+	CheckChallenge(ctx context.Context, mfaToken string, maxAttempts int) (int, string, error)
+	DeleteChallenge(ctx context.Context, mfaToken string) error
+}
+
+type PgTwoFactorRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgTwoFactorRepository(db *pgxpool.Pool) *PgTwoFactorRepository {
+	return &PgTwoFactorRepository{db: db}
+}
+
+func (r *PgTwoFactorRepository) IsEnabled(ctx context.Context, userID int) (bool, error) {
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+	query := "SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = @userID AND enabled)"
+	var enabled bool
+	err := r.db.QueryRow(ctx, query, args).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+func (r *PgTwoFactorRepository) SetPendingSecret(ctx context.Context, userID int, secret string) error {
+	args := pgx.NamedArgs{
+		"userID": userID,
+		"secret": secret,
+	}
+	query := `INSERT INTO user_totp (user_id, secret) VALUES (@userID, @secret)
+		ON CONFLICT (user_id) DO UPDATE SET secret = @secret, last_used_step = 0, created_at = NOW()
+		WHERE NOT user_totp.enabled`
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return fmt.Errorf("unable to store totp secret: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTwoFactorAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *PgTwoFactorRepository) GetSecret(ctx context.Context, userID int) (string, bool, error) {
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+	query := "SELECT secret, enabled FROM user_totp WHERE user_id = @userID"
+	var secret string
+	var enabled bool
+	err := r.db.QueryRow(ctx, query, args).Scan(&secret, &enabled)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", false, ErrTwoFactorNotEnrolled
+		}
+		return "", false, err
+	}
+	return secret, enabled, nil
+}
+
+func (r *PgTwoFactorRepository) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	args := pgx.NamedArgs{
+		"userID": userID,
+		"step":   step,
+	}
+	query := "UPDATE user_totp SET last_used_step = @step WHERE user_id = @userID AND last_used_step < @step"
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PgTwoFactorRepository) Enable(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	args := pgx.NamedArgs{
+		"userID": userID,
+		"step":   step,
+	}
+	query := "UPDATE user_totp SET enabled = TRUE, confirmed_at = NOW(), last_used_step = @step WHERE user_id = @userID AND NOT enabled AND last_used_step < @step"
+	tag, err := tx.Exec(ctx, query, args)
+	if err != nil {
+		return fmt.Errorf("unable to enable totp: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = @userID", args)
+	if err != nil {
+		return fmt.Errorf("unable to delete recovery codes: %w", err)
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		codeArgs := pgx.NamedArgs{
+			"userID":   userID,
+			"codeHash": codeHash,
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (@userID, @codeHash)", codeArgs)
+		if err != nil {
+			return fmt.Errorf("unable to insert recovery code: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *PgTwoFactorRepository) Disable(ctx context.Context, userID int) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = @userID", args)
+	if err != nil {
+		return fmt.Errorf("unable to delete recovery codes: %w", err)
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM user_totp WHERE user_id = @userID", args)
+	if err != nil {
+		return fmt.Errorf("unable to delete totp secret: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *PgTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	args := pgx.NamedArgs{
+		"userID":   userID,
+		"codeHash": codeHash,
+	}
+	query := "UPDATE recovery_codes SET used_at = NOW() WHERE user_id = @userID AND code_hash = @codeHash AND used_at IS NULL"
+	tag, err := r.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PgTwoFactorRepository) CreateChallenge(ctx context.Context, userID int, authMode string, ttl time.Duration) (string, error) {
+	mfaToken, err := auth.GenerateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate mfa token: %w", err)
+	}
+
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(mfaToken),
+		"userID":    userID,
+		"authMode":  authMode,
+		"ttl":       ttl.Seconds(),
+	}
+	query := "INSERT INTO mfa_challenges (token_hash, user_id, auth_mode, expires_at) VALUES (@tokenHash, @userID, @authMode, NOW() + make_interval(secs => @ttl))"
+	_, err = r.db.Exec(ctx, query, args)
+	if err != nil {
+		return "", fmt.Errorf("unable to insert mfa challenge: %w", err)
+	}
+	return mfaToken, nil
+}
+
+func (r *PgTwoFactorRepository) CheckChallenge(ctx context.Context, mfaToken string, maxAttempts int) (int, string, error) {
+	args := pgx.NamedArgs{
+		"tokenHash":   auth.HashToken(mfaToken),
+		"maxAttempts": maxAttempts,
+	}
+	query := `UPDATE mfa_challenges SET attempts = attempts + 1
+		WHERE token_hash = @tokenHash AND expires_at > NOW() AND attempts < @maxAttempts
+		RETURNING user_id, auth_mode`
+	var userID int
+	var authMode string
+	err := r.db.QueryRow(ctx, query, args).Scan(&userID, &authMode)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return -1, "", ErrInvalidMFAToken
+		}
+		return -1, "", err
+	}
+	return userID, authMode, nil
+}
+
+func (r *PgTwoFactorRepository) DeleteChallenge(ctx context.Context, mfaToken string) error {
+	args := pgx.NamedArgs{
+		"tokenHash": auth.HashToken(mfaToken),
+	}
+	//expired challenges of all users go with it, nothing else cleans them up
+	_, err := r.db.Exec(ctx, "DELETE FROM mfa_challenges WHERE token_hash = @tokenHash OR expires_at < NOW()", args)
+	return err
+}
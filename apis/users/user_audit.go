@@ -0,0 +1,67 @@
+package users
+
+import (
+	"context"
+
+	"github.com/defilippomattia/gorest/audit"
+)
+
+// reasons of failed logins in the audit log
+const (
+	failedLoginInvalidCredentials  = "invalid_credentials"
+	failedLoginLocked              = "locked"
+	failedLoginInvalidSecondFactor = "invalid_second_factor"
+	failedLoginInvalidIDToken      = "invalid_id_token"
+)
+
+// auditedUser are the user fields recorded when a user is created, the password never is.
+type auditedUser struct {
+	Username string  `json:"username"`
+	Email    *string `json:"email"`
+}
+
+func (h *UserHandler) recordUserCreated(ctx context.Context, userID int, user auditedUser) {
+	h.auditLog.Record(ctx, audit.Event{
+		Action:       audit.ActionCreate,
+		ResourceType: audit.ResourceUser,
+		ResourceID:   audit.ResourceID(userID),
+		Changes:      audit.Diff(nil, user),
+	})
+}
+
+func (h *UserHandler) recordUserUpdated(ctx context.Context, userID int, changes map[string]audit.Change) {
+	h.auditLog.Record(ctx, audit.Event{
+		Action:       audit.ActionUpdate,
+		ResourceType: audit.ResourceUser,
+		ResourceID:   audit.ResourceID(userID),
+		Changes:      changes,
+	})
+}
+
+// recordAuthEvent records logins and logouts, the user is the actor even though the
+// request was not authenticated yet.
+func (h *UserHandler) recordAuthEvent(ctx context.Context, action string, userID int, metadata map[string]string) {
+	h.auditLog.Record(ctx, audit.Event{
+		ActorUserID:  &userID,
+		Action:       action,
+		ResourceType: audit.ResourceUser,
+		ResourceID:   audit.ResourceID(userID),
+		Metadata:     metadata,
+	})
+}
+
+// recordFailedLogin keeps the attempted username, userID is -1 when the user is not known.
+func (h *UserHandler) recordFailedLogin(ctx context.Context, userID int, username string, reason string) {
+	event := audit.Event{
+		Action:       audit.ActionLoginFailed,
+		ResourceType: audit.ResourceUser,
+		Metadata:     map[string]string{"reason": reason},
+	}
+	if userID != -1 {
+		event.ResourceID = audit.ResourceID(userID)
+	}
+	if username != "" {
+		event.Metadata["username"] = username
+	}
+	h.auditLog.Record(ctx, event)
+}
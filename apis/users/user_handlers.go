@@ -1,31 +1,46 @@
 package users
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/auth"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/defilippomattia/gorest/middleware"
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 )
 
 type UserHandler struct {
-	repo UserRepository
+	repo              UserRepository
+	loginProtection   *LoginProtection
+	passwordPolicy    *auth.PasswordPolicy
+	tokenAuth         *TokenAuth
+	twoFactor         *TwoFactor
+	passwordReset     *PasswordReset
+	emailVerification *EmailVerification
+	auditLog          *audit.Recorder
 }
 
-func NewUserHandler(repo UserRepository) *UserHandler {
-	return &UserHandler{repo: repo}
+// NewUserHandler accepts a nil tokenAuth when the token auth mode is disabled.
+func NewUserHandler(repo UserRepository, loginProtection *LoginProtection, passwordPolicy *auth.PasswordPolicy, tokenAuth *TokenAuth, twoFactor *TwoFactor, passwordReset *PasswordReset, emailVerification *EmailVerification, auditLog *audit.Recorder) *UserHandler {
+	return &UserHandler{repo: repo, loginProtection: loginProtection, passwordPolicy: passwordPolicy, tokenAuth: tokenAuth, twoFactor: twoFactor, passwordReset: passwordReset, emailVerification: emailVerification, auditLog: auditLog}
 }
 
 func (h *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 	var usLogReq UserLoginRequest
 
-	err := json.NewDecoder(r.Body).Decode(&usLogReq)
+	err := apis.DecodeJSON(r, &usLogReq)
 	if err != nil {
-		log.Error().Err(err).Msg("could not decode usLoginReq")
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode usLoginReq")
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(apis.DecodeErrorStatus(err))
 		json.NewEncoder(w).Encode(UserLoginErrorResponse{
 			ResponseType: "error",
 			Message:      "invalid request - username and password must be provided",
@@ -36,7 +51,7 @@ func (h *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 	validate := validator.New()
 	err = validate.Struct(usLogReq)
 	if err != nil {
-		log.Error().Err(err).Msg("json body in request not valid")
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(UserLoginErrorResponse{
@@ -46,10 +61,58 @@ func (h *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionToken, err := h.repo.Login(context.Background(), &usLogReq)
+	if usLogReq.AuthMode == AuthModeToken && h.tokenAuth == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "invalid request - token auth mode is not enabled",
+		})
+		return
+	}
+
+	clientIP := middleware.ClientIP(r)
+	locked, err := h.loginProtection.IsLocked(r.Context(), usLogReq.Username, clientIP)
 	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error checking login lockout")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not log in",
+		})
+		return
+	}
+	if locked {
+		//same answer as a wrong password, a locked username must not look different from an unknown one
+		metrics.FailedLoginsTotal.Inc()
+		log.Ctx(r.Context()).Warn().
+			Str("event", "auth.locked_login").
+			Str("username", usLogReq.Username).
+			Str("ip", clientIP).
+			Msg("login attempt while locked")
+		h.recordFailedLogin(r.Context(), -1, usLogReq.Username, failedLoginLocked)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      ErrInvalidCredentials.Error(),
+		})
+		return
+	}
+
+	userID, err := h.repo.Login(r.Context(), &usLogReq)
+	if hashingBusy(w, r, err) {
+		return
+	}
+	if err != nil {
+		metrics.FailedLoginsTotal.Inc()
+		if errors.Is(err, ErrInvalidCredentials) {
+			h.recordFailedLogin(r.Context(), -1, usLogReq.Username, failedLoginInvalidCredentials)
+			h.delayFailedLogin(r, usLogReq.Username, clientIP)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusUnauthorized))
 		json.NewEncoder(w).Encode(UserLoginErrorResponse{
 			ResponseType: "error",
 			Message:      err.Error(),
@@ -57,6 +120,63 @@ func (h *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.emailVerification.Required {
+		user, err := h.repo.GetByID(r.Context(), userID)
+		if err != nil {
+			writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log in")
+			return
+		}
+		if !user.EmailVerified {
+			log.Ctx(r.Context()).Info().Int("user_id", userID).Msg("login refused, email not verified")
+			writeUserError(w, http.StatusForbidden, ErrEmailNotVerified.Error())
+			return
+		}
+	}
+
+	twoFactorEnabled, err := h.twoFactor.Repo.IsEnabled(r.Context(), userID)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error checking two-factor authentication")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not log in",
+		})
+		return
+	}
+	if twoFactorEnabled {
+		//failures are only reset after the second factor, else the password would reset the lockout of wrong codes
+		h.startTwoFactorLogin(w, r, userID, usLogReq.AuthMode)
+		return
+	}
+
+	err = h.loginProtection.RecordSuccess(r.Context(), usLogReq.Username)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error resetting failed logins")
+	}
+
+	h.completeLogin(w, r, userID, usLogReq.AuthMode)
+}
+
+// completeLogin answers a login whose credentials were verified with a session cookie and
+// its CSRF token, or with an access and refresh token in the token auth mode.
+func (h *UserHandler) completeLogin(w http.ResponseWriter, r *http.Request, userID int, authMode string) {
+	if authMode == AuthModeToken {
+		h.issueTokens(w, r, userID, "")
+		return
+	}
+
+	sessionToken, err := h.repo.CreateSession(r.Context(), userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not create session",
+		})
+		return
+	}
+
 	cookie := http.Cookie{
 		Name:     "session_token",
 		Value:    sessionToken,
@@ -66,19 +186,51 @@ func (h *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		Secure:   true,
 		SameSite: http.SameSiteLaxMode,
 	}
+	//readable by the frontend, which sends it back in the X-CSRF-Token header
+	csrfToken := auth.CSRFToken(sessionToken)
+	csrfCookie := http.Cookie{
+		Name:     "csrf_token",
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   3600,
+		HttpOnly: false,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	metrics.LoginsTotal.Inc()
+	h.recordAuthEvent(r.Context(), audit.ActionLogin, userID, map[string]string{"auth_mode": AuthModeCookie})
 	http.SetCookie(w, &cookie)
+	http.SetCookie(w, &csrfCookie)
+	w.Header().Set(middleware.CSRFHeader, csrfToken)
 	w.Write([]byte(sessionToken))
 }
 
+// delayFailedLogin records the failure and holds the response back, the delay grows with
+// every consecutive failure. It returns early when the client goes away.
+func (h *UserHandler) delayFailedLogin(r *http.Request, username string, clientIP string) {
+	delay, err := h.loginProtection.RecordFailure(r.Context(), username, clientIP)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error recording failed login")
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
 func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	var usRegReq UserRegistrationRequest
 
 	//todo: try to simplify (duplicate code for err handling)
-	err := json.NewDecoder(r.Body).Decode(&usRegReq)
+	err := apis.DecodeJSON(r, &usRegReq)
 	if err != nil {
-		log.Error().Err(err).Msg("could not decode usRegReq")
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode usRegReq")
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(apis.DecodeErrorStatus(err))
 		json.NewEncoder(w).Encode(UserRegistrationErrorResponse{
 			ResponseType: "error",
 			Message:      "invalid request - username and password must be provided",
@@ -89,7 +241,7 @@ func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	validate := validator.New()
 	err = validate.Struct(usRegReq)
 	if err != nil {
-		log.Error().Err(err).Msg("json body in request not valid")
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(UserRegistrationErrorResponse{
@@ -99,11 +251,18 @@ func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId, err := h.repo.Register(context.Background(), &usRegReq)
+	if h.rejectPassword(w, r, usRegReq.Password, usRegReq.Username, usRegReq.Email) {
+		return
+	}
 
+	userId, err := h.repo.Register(r.Context(), &usRegReq)
+	if hashingBusy(w, r, err) {
+		return
+	}
 	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusUnauthorized)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(UserRegistrationErrorResponse{
 			ResponseType: "error",
 			Message:      err.Error(),
@@ -111,9 +270,20 @@ func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().
+	metrics.RegistrationsTotal.Inc()
+	log.Ctx(r.Context()).Info().
 		Int("user_id", userId).
 		Msg("user registered successfully")
+	auditedUser := auditedUser{Username: usRegReq.Username}
+	if usRegReq.Email != "" {
+		email := strings.ToLower(usRegReq.Email)
+		auditedUser.Email = &email
+	}
+	h.recordUserCreated(r.Context(), userId, auditedUser)
+
+	if usRegReq.Email != "" {
+		h.queueVerificationMail(r.Context(), userId, strings.ToLower(usRegReq.Email))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -125,31 +295,213 @@ func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func writeUserError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UserLoginErrorResponse{
+		ResponseType: "error",
+		Message:      message,
+	})
+}
+
+// hashingBusy answers with 503 and Retry-After when err comes from a saturated hashing pool,
+// the caller must stop handling the request when it returns true.
+func hashingBusy(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, auth.ErrHashingBusy) {
+		return false
+	}
+
+	log.Ctx(r.Context()).Warn().Err(err).Msg("no free password hashing slot")
+	w.Header().Set("Retry-After", strconv.Itoa(int(auth.HashingRetryAfter.Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(UserLoginErrorResponse{
+		ResponseType: "error",
+		Message:      "server busy - retry later",
+	})
+	return true
+}
+
+// rejectPassword writes a 400 listing every violated rule when the password does not
+// satisfy the password policy, the caller must stop handling the request when it returns true.
+func (h *UserHandler) rejectPassword(w http.ResponseWriter, r *http.Request, password string, username string, email string) bool {
+	violations := h.passwordPolicy.Validate(password, username, email)
+	if len(violations) == 0 {
+		return false
+	}
+
+	log.Ctx(r.Context()).Info().Strs("violations", violations).Msg("password rejected by password policy")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(PasswordPolicyErrorResponse{
+		ResponseType: "error",
+		Message:      "invalid request - password does not satisfy the password policy",
+		Errors:       violations,
+	})
+	return true
+}
+
 func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r.Context())
+	log.Ctx(r.Context()).Debug().Int("user_id", userID).Msg("session token is valid")
+}
+
+// Logout ends the session of the session_token cookie. Access tokens expire on their own,
+// so requests authenticated otherwise have nothing to end.
+func (h *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if middleware.GetAuthMethod(r.Context()) != middleware.AuthMethodSession {
+		writeUserError(w, http.StatusBadRequest, "invalid request - only session logins can be logged out")
+		return
+	}
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
-		log.Error().Err(err).Msg("no session token provided")
+		writeUserError(w, http.StatusBadRequest, "invalid request - session_token cookie is missing")
+		return
+	}
+
+	userID := middleware.GetUserID(r.Context())
+	err = h.repo.DeleteSession(r.Context(), cookie.Value)
+	if err != nil {
+		writeUserError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not log out")
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Int("user_id", userID).Msg("user logged out")
+	h.recordAuthEvent(r.Context(), audit.ActionLogout, userID, map[string]string{"auth_mode": AuthModeCookie})
+
+	http.SetCookie(w, &http.Cookie{Name: "session_token", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: "csrf_token", Path: "/", MaxAge: -1, Secure: true, SameSite: http.SameSiteLaxMode})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogoutSuccessResponse{
+		ResponseType: "success",
+		Message:      "logged out",
+	})
+}
+
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var changeReq ChangePasswordRequest
+
+	err := apis.DecodeJSON(r, &changeReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode changeReq")
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(apis.DecodeErrorStatus(err))
 		json.NewEncoder(w).Encode(UserLoginErrorResponse{
 			ResponseType: "error",
-			Message:      "unauthorized - session token is missing or invalid",
+			Message:      "invalid request - current_password and new_password must be provided",
 		})
 		return
 	}
-	fmt.Println(cookie.Value)
 
-	userID, err := h.repo.ValidateSessionToken(context.Background(), cookie.Value)
+	validate := validator.New()
+	err = validate.Struct(changeReq)
 	if err != nil {
-		log.Error().Err(err).Msg("invalid session token")
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(UserLoginErrorResponse{
 			ResponseType: "error",
-			Message:      "unauthorized - session token is missing or invalid",
+			Message:      "invalid request - current_password and new_password must be provided",
 		})
 		return
 	}
-	fmt.Println(userID)
 
+	userID := middleware.GetUserID(r.Context())
+	user, err := h.repo.GetByID(r.Context(), userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not change password",
+		})
+		return
+	}
+
+	if h.rejectPassword(w, r, changeReq.NewPassword, user.Username, user.EmailAddress()) {
+		return
+	}
+
+	err = h.repo.ChangePassword(r.Context(), userID, changeReq.CurrentPassword, changeReq.NewPassword)
+	if hashingBusy(w, r, err) {
+		return
+	}
+	if err != nil {
+		status := apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError)
+		message := "could not change password"
+		if errors.Is(err, ErrWrongPassword) {
+			status = http.StatusForbidden
+			message = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      message,
+		})
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Int("user_id", userID).Msg("password changed")
+	h.recordUserUpdated(r.Context(), userID, audit.Redacted("password"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChangePasswordSuccessResponse{
+		ResponseType: "success",
+		Message:      "password changed",
+	})
+}
+
+func (h *UserHandler) UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	var unlockReq UnlockLoginRequest
+
+	err := apis.DecodeJSON(r, &unlockReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("could not decode unlockReq")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.DecodeErrorStatus(err))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "invalid request - username or ip must be provided",
+		})
+		return
+	}
+
+	validate := validator.New()
+	err = validate.Struct(unlockReq)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("json body in request not valid")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "invalid request - username or ip must be provided",
+		})
+		return
+	}
+
+	err = h.loginProtection.Unlock(r.Context(), unlockReq.Username, unlockReq.IP)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error unlocking login")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError))
+		json.NewEncoder(w).Encode(UserLoginErrorResponse{
+			ResponseType: "error",
+			Message:      "could not unlock login",
+		})
+		return
+	}
+
+	log.Ctx(r.Context()).Info().
+		Str("event", "auth.unlock").
+		Str("username", unlockReq.Username).
+		Str("ip", unlockReq.IP).
+		Int("admin_user_id", middleware.GetUserID(r.Context())).
+		Msg("login unlocked by admin")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UnlockLoginSuccessResponse{
+		ResponseType: "success",
+		Message:      "login unlocked",
+	})
 }
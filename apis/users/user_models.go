@@ -4,11 +4,24 @@ type User struct {
 	ID       int
 	Username string
 	Password string
+	Email    *string
+	// false for users without email
+	EmailVerified bool
+}
+
+// EmailAddress is the email of the user, empty when the user has none.
+func (u *User) EmailAddress() string {
+	if u.Email == nil {
+		return ""
+	}
+	return *u.Email
 }
 
 type UserRegistrationRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	// optional, a verification mail is sent to it
+	Email string `json:"email" validate:"omitempty,email,max=255"`
 }
 
 type UserRegistrationSuccessResponse struct {
@@ -22,12 +35,85 @@ type UserRegistrationErrorResponse struct {
 	Message      string `json:"message" validate:"required"`
 }
 
+const (
+	AuthModeCookie = "cookie"
+	AuthModeToken  = "token"
+)
+
 type UserLoginRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	// cookie (default) answers with a session cookie, token with an access and refresh token
+	AuthMode string `json:"auth_mode" validate:"omitempty,oneof=cookie token"`
 }
 
 type UserLoginErrorResponse struct {
 	ResponseType string `json:"response_type" validate:"required"`
 	Message      string `json:"message" validate:"required"`
 }
+
+type UnlockLoginRequest struct {
+	Username string `json:"username" validate:"required_without=IP"`
+	IP       string `json:"ip" validate:"omitempty,ip"`
+}
+
+type UnlockLoginSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
+
+type PasswordPolicyErrorResponse struct {
+	ResponseType string   `json:"response_type" validate:"required"`
+	Message      string   `json:"message" validate:"required"`
+	Errors       []string `json:"errors" validate:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type ChangePasswordSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
+
+type LogoutSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token" validate:"required"`
+	TokenType    string `json:"token_type" validate:"required"`
+	ExpiresIn    int    `json:"expires_in" validate:"required"`
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type PasswordResetSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
+
+type EmailVerificationResendRequest struct {
+	Username string `json:"username" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
+}
+
+type EmailVerificationSuccessResponse struct {
+	ResponseType string `json:"response_type" validate:"required"`
+	Message      string `json:"message" validate:"required"`
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/defilippomattia/gorest/auth"
 	"github.com/jackc/pgx/v5"
@@ -11,10 +12,35 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// ErrInvalidCredentials is returned for unknown usernames and wrong passwords alike,
+// so the response does not reveal which usernames exist.
+var ErrInvalidCredentials = errors.New("username and password do not match")
+
+var ErrWrongPassword = errors.New("current password is not correct")
+
+var ErrUserNotFound = errors.New("user not found")
+
+var ErrEmailInUse = errors.New("email already verified by another user")
+
+var ErrUsernameTaken = errors.New("username already exists")
+
 type UserRepository interface {
 	Register(ctx context.Context, usRegReq *UserRegistrationRequest) (int, error)
-	Login(ctx context.Context, usLogReq *UserLoginRequest) (string, error)
+	Login(ctx context.Context, usLogReq *UserLoginRequest) (int, error)
+	CreateSession(ctx context.Context, userID int) (string, error)
 	ValidateSessionToken(ctx context.Context, sessionToken string) (int, error)
+	DeleteSession(ctx context.Context, sessionToken string) error
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	GetByID(ctx context.Context, userID int) (*User, error)
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	ChangePassword(ctx context.Context, userID int, currentPassword string, newPassword string) error
+}
+
+const userColumns = "id, username, password, email, email_verified_at IS NOT NULL"
+
+func scanUser(row pgx.Row, user *User) error {
+	return row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.EmailVerified)
 }
 
 type PgUserRepository struct {
@@ -25,9 +51,9 @@ func NewPgUserRepository(db *pgxpool.Pool) *PgUserRepository {
 	return &PgUserRepository{db: db}
 }
 
-func (r *PgUserRepository) Login(ctx context.Context, user *UserLoginRequest) (string, error) {
-	sessionToken := auth.GenerateSessionToken()
-
+// Login checks the credentials and returns the id of the user, the caller decides
+// whether a session or tokens are issued.
+func (r *PgUserRepository) Login(ctx context.Context, user *UserLoginRequest) (int, error) {
 	getUserArgs := pgx.NamedArgs{
 		"username": user.Username,
 	}
@@ -39,57 +65,76 @@ func (r *PgUserRepository) Login(ctx context.Context, user *UserLoginRequest) (s
 	err := r.db.QueryRow(ctx, getUserQuery, getUserArgs).Scan(&userInDb.ID, &userInDb.Username, &userInDb.Password)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			log.Error().Str("username", user.Username).Msg("username not found")
-			return "", errors.New("username and password do not match")
+			log.Ctx(ctx).Error().Str("username", user.Username).Msg("username not found")
+			return -1, ErrInvalidCredentials
 		}
-		log.Error().Err(err).Msg("error getting password from database")
-		return "", err
+		log.Ctx(ctx).Error().Err(err).Msg("error getting password from database")
+		return -1, err
 	}
 
-	match, err := auth.ComparePasswordAndHash(user.Password, userInDb.Password)
+	match, err := auth.ComparePasswordAndHash(ctx, user.Password, userInDb.Password)
 	if err != nil {
-		log.Error().Err(err).Msg("error comparing password and hash")
-		return "", err
+		log.Ctx(ctx).Error().Err(err).Msg("error comparing password and hash")
+		return -1, err
 	}
 
 	if !match {
-		log.Error().Str("username", user.Username).Msg("username and password do not match")
-		return "", errors.New("username and password do not match")
+		log.Ctx(ctx).Error().Str("username", user.Username).Msg("username and password do not match")
+		return -1, ErrInvalidCredentials
 	}
 
+	r.rehashIfNeeded(ctx, &userInDb, user.Password)
+
+	log.Ctx(ctx).Info().Str("username", user.Username).Msg("user logged in")
+
+	return userInDb.ID, nil
+}
+
+func (r *PgUserRepository) CreateSession(ctx context.Context, userID int) (string, error) {
 	//todo: check if session already exists for user and delete it maybe?
 
+	sessionToken, err := auth.GenerateSessionToken()
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error generating session token")
+		return "", err
+	}
+
 	insertSessionArgs := pgx.NamedArgs{
-		"user_id": userInDb.ID,
-		"token":   sessionToken,
+		"user_id":    userID,
+		"token_hash": auth.HashToken(sessionToken),
 	}
 
-	insertSessionQuery := "INSERT INTO sessions (user_id, token) VALUES (@user_id, @token)"
+	insertSessionQuery := "INSERT INTO sessions (user_id, token_hash) VALUES (@user_id, @token_hash)"
 
 	_, err = r.db.Exec(ctx, insertSessionQuery, insertSessionArgs)
 	if err != nil {
-		log.Error().Err(err).Msg("error inserting session into database")
+		log.Ctx(ctx).Error().Err(err).Msg("error inserting session into database")
 		return "", err
 	}
 
-	log.Info().Str("username", user.Username).Msg("user logged in")
-
 	return sessionToken, nil
 }
 
 func (r *PgUserRepository) Register(ctx context.Context, user *UserRegistrationRequest) (int, error) {
 
-	hashedPassword, err := auth.HashPassword(user.Password)
+	hashedPassword, err := auth.HashPassword(ctx, user.Password)
 	if err != nil {
-		log.Error().Err(err).Msg("error hashing password")
+		log.Ctx(ctx).Error().Err(err).Msg("error hashing password")
 		return -1, err
 	}
 
+	var email *string
+	if user.Email != "" {
+		lowerEmail := strings.ToLower(user.Email)
+		email = &lowerEmail
+	}
+
 	args := pgx.NamedArgs{
 		"username": user.Username,
 		"password": hashedPassword,
+		"email":    email,
 	}
-	query := "INSERT INTO users (username, password) VALUES (@username, @password) RETURNING id"
+	query := "INSERT INTO users (username, password, email) VALUES (@username, @password, @email) RETURNING id"
 	var userID int
 
 	err = r.db.QueryRow(ctx, query, args).Scan(&userID)
@@ -97,10 +142,10 @@ func (r *PgUserRepository) Register(ctx context.Context, user *UserRegistrationR
 	if err != nil {
 		pgErr, isPgError := err.(*pgconn.PgError)
 		if isPgError && pgErr.Code == "23505" {
-			log.Error().Str("username", user.Username).Msg("username already exists")
-			return -1, errors.New("username already exists")
+			log.Ctx(ctx).Error().Str("username", user.Username).Msg("username already exists")
+			return -1, ErrUsernameTaken
 		}
-		log.Error().Err(err).Msg("error inserting new user")
+		log.Ctx(ctx).Error().Err(err).Msg("error inserting new user")
 		return -1, err
 	}
 
@@ -111,20 +156,176 @@ func (r *PgUserRepository) Register(ctx context.Context, user *UserRegistrationR
 func (r *PgUserRepository) ValidateSessionToken(ctx context.Context, sessionToken string) (int, error) {
 	var userId int
 	args := pgx.NamedArgs{
-		"token": sessionToken,
+		"token_hash": auth.HashToken(sessionToken),
 	}
 
-	query := "SELECT user_id FROM sessions WHERE token = @token"
+	query := "SELECT user_id FROM sessions WHERE token_hash = @token_hash"
 
 	err := r.db.QueryRow(ctx, query, args).Scan(&userId)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			log.Error().Str("session_token", sessionToken).Msg("session token not found")
+			log.Ctx(ctx).Error().Msg("session token not found")
 			return -1, errors.New("session token not found")
 		}
-		log.Error().Err(err).Msg("error getting user_id from session token")
+		log.Ctx(ctx).Error().Err(err).Msg("error getting user_id from session token")
 		return -1, err
 	}
 
 	return userId, nil
 }
+
+func (r *PgUserRepository) DeleteSession(ctx context.Context, sessionToken string) error {
+	args := pgx.NamedArgs{
+		"token_hash": auth.HashToken(sessionToken),
+	}
+	_, err := r.db.Exec(ctx, "DELETE FROM sessions WHERE token_hash = @token_hash", args)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error deleting session from database")
+		return err
+	}
+	return nil
+}
+
+func (r *PgUserRepository) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	args := pgx.NamedArgs{
+		"id": userID,
+	}
+	query := "SELECT is_admin FROM users WHERE id = @id"
+
+	var isAdmin bool
+	err := r.db.QueryRow(ctx, query, args).Scan(&isAdmin)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		log.Ctx(ctx).Error().Err(err).Msg("error getting is_admin from database")
+		return false, err
+	}
+
+	return isAdmin, nil
+}
+
+func (r *PgUserRepository) GetByID(ctx context.Context, userID int) (*User, error) {
+	args := pgx.NamedArgs{
+		"id": userID,
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE id = @id"
+
+	var user User
+	err := scanUser(r.db.QueryRow(ctx, query, args), &user)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("user_id", userID).Msg("error getting user from database")
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetByUsername returns ErrUserNotFound when no user has the username.
+func (r *PgUserRepository) GetByUsername(ctx context.Context, username string) (*User, error) {
+	args := pgx.NamedArgs{
+		"username": username,
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE username = @username"
+
+	var user User
+	err := scanUser(r.db.QueryRow(ctx, query, args), &user)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		log.Ctx(ctx).Error().Err(err).Msg("error getting user by username from database")
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetByEmail returns the user that verified the email, or ErrUserNotFound. Unverified
+// emails are claims anyone can make, so they never resolve to a user.
+func (r *PgUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	args := pgx.NamedArgs{
+		"email": email,
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE LOWER(email) = LOWER(@email) AND email_verified_at IS NOT NULL"
+
+	var user User
+	err := scanUser(r.db.QueryRow(ctx, query, args), &user)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		log.Ctx(ctx).Error().Err(err).Msg("error getting user by email from database")
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *PgUserRepository) ChangePassword(ctx context.Context, userID int, currentPassword string, newPassword string) error {
+	user, err := r.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	match, err := auth.ComparePasswordAndHash(ctx, currentPassword, user.Password)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error comparing password and hash")
+		return err
+	}
+	if !match {
+		log.Ctx(ctx).Error().Int("user_id", userID).Msg("current password does not match")
+		return ErrWrongPassword
+	}
+
+	hashedPassword, err := auth.HashPassword(ctx, newPassword)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error hashing password")
+		return err
+	}
+
+	args := pgx.NamedArgs{
+		"id":       userID,
+		"password": hashedPassword,
+	}
+	query := "UPDATE users SET password = @password WHERE id = @id"
+
+	_, err = r.db.Exec(ctx, query, args)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error updating password")
+		return err
+	}
+
+	return nil
+}
+
+// rehashIfNeeded upgrades a hash created with outdated argon2 params. Failures are only
+// logged, the login itself is still valid and the next one will try again.
+func (r *PgUserRepository) rehashIfNeeded(ctx context.Context, user *User, plainPassword string) {
+	needsRehash, err := auth.NeedsRehash(user.Password)
+	if err != nil || !needsRehash {
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(ctx, plainPassword)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error rehashing password")
+		return
+	}
+
+	args := pgx.NamedArgs{
+		"id":          user.ID,
+		"password":    hashedPassword,
+		"oldPassword": user.Password,
+	}
+	//only replace the hash we verified, a concurrent password change wins
+	query := "UPDATE users SET password = @password WHERE id = @id AND password = @oldPassword"
+
+	_, err = r.db.Exec(ctx, query, args)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error storing rehashed password")
+		return
+	}
+
+	log.Ctx(ctx).Info().Int("user_id", user.ID).Msg("password rehashed with current argon2 params")
+}
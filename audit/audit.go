@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// undoes a soft delete
+	ActionRestore = "restore"
+	// soft deleted resources removed for good once their retention passed
+	ActionPurge = "purge"
+
+	ActionLogin       = "login"
+	ActionLoginFailed = "login_failed"
+	ActionLogout      = "logout"
+)
+
+const (
+	ResourceCompany    = "company"
+	ResourceDepartment = "department"
+	ResourceEmployee   = "employee"
+	ResourceUser       = "user"
+)
+
+// values of secret fields never reach the audit log, only the fact that they changed
+const redacted = "************"
+
+// Change is the value of one field before and after the operation, Before is missing
+// for created resources and After for deleted ones.
+type Change struct {
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+type Event struct {
+	ID int64 `json:"id"`
+	// nil for anonymous requests like registration or failed logins
+	ActorUserID  *int              `json:"actor_user_id"`
+	Action       string            `json:"action"`
+	ResourceType string            `json:"resource_type"`
+	ResourceID   string            `json:"resource_id"`
+	Changes      map[string]Change `json:"changes,omitempty"`
+	// context that is not a change, like the username of a failed login
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	RequestID string            `json:"request_id"`
+	IP        string            `json:"ip"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Recorder writes audit events. Recording never fails the request, errors are logged.
+type Recorder struct {
+	repo Repository
+}
+
+func NewRecorder(repo Repository) *Recorder {
+	return &Recorder{repo: repo}
+}
+
+// Record stores the event. Actor, request id and ip are taken from the request context
+// unless the event already has them. The event is stored even when the client went away,
+// the operation it describes already happened.
+func (r *Recorder) Record(ctx context.Context, event Event) {
+	if event.ActorUserID == nil {
+		if userID := middleware.GetUserID(ctx); userID != -1 {
+			event.ActorUserID = &userID
+		}
+	}
+	if event.RequestID == "" {
+		event.RequestID = middleware.GetRequestID(ctx)
+	}
+	if event.IP == "" {
+		event.IP = middleware.GetClientIP(ctx)
+	}
+
+	err := r.repo.Insert(context.WithoutCancel(ctx), &event)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).
+			Str("action", event.Action).
+			Str("resource_type", event.ResourceType).
+			Str("resource_id", event.ResourceID).
+			Msg("error recording audit event")
+	}
+}
+
+// ResourceID formats numeric ids, resource ids are stored as text.
+func ResourceID(id int) string {
+	return strconv.Itoa(id)
+}
+
+// Diff returns the fields that differ between before and after, both are compared by their
+// json representation. Pass nil as before for created and as after for deleted resources.
+func Diff(before any, after any) map[string]Change {
+	beforeFields := jsonFields(before)
+	afterFields := jsonFields(after)
+
+	changes := make(map[string]Change)
+	for field, beforeValue := range beforeFields {
+		afterValue, ok := afterFields[field]
+		if !ok || !reflect.DeepEqual(beforeValue, afterValue) {
+			changes[field] = Change{Before: beforeValue, After: afterValue}
+		}
+	}
+	for field, afterValue := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changes[field] = Change{After: afterValue}
+		}
+	}
+	return changes
+}
+
+// Redacted records that the secret fields changed without their values.
+func Redacted(fields ...string) map[string]Change {
+	changes := make(map[string]Change, len(fields))
+	for _, field := range fields {
+		changes[field] = Change{Before: redacted, After: redacted}
+	}
+	return changes
+}
+
+func jsonFields(v any) map[string]any {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil() {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]any
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil
+	}
+	return fields
+}
@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type EventsResponse struct {
+	ResponseType string  `json:"response_type"`
+	Events       []Event `json:"events"`
+	// pass as before_id to get the next page, nil on the last page
+	NextBeforeID *int64 `json:"next_before_id"`
+}
+
+type errorResponse struct {
+	ResponseType string `json:"response_type"`
+	Message      string `json:"message"`
+}
+
+func writeAuditError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		ResponseType: "error",
+		Message:      message,
+	})
+}
+
+type Handler struct {
+	repo Repository
+}
+
+func NewHandler(repo Repository) *Handler {
+	return &Handler{repo: repo}
+}
+
+// GetEvents lists audit events newest first. It accepts the query parameters actor_user_id,
+// action, resource_type, resource_id, from and to (RFC 3339), limit and before_id.
+func (h *Handler) GetEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := Filter{
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resource_type"),
+		ResourceID:   query.Get("resource_id"),
+		Limit:        defaultPageSize,
+	}
+
+	if value := query.Get("actor_user_id"); value != "" {
+		actorUserID, err := strconv.Atoi(value)
+		if err != nil {
+			writeAuditError(w, http.StatusBadRequest, "invalid request - actor_user_id must be a number")
+			return
+		}
+		filter.ActorUserID = &actorUserID
+	}
+	for name, target := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeAuditError(w, http.StatusBadRequest, "invalid request - "+name+" must be an RFC 3339 timestamp")
+			return
+		}
+		*target = &parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeAuditError(w, http.StatusBadRequest, "invalid request - limit must be between 1 and "+strconv.Itoa(maxPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("before_id"); value != "" {
+		beforeID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || beforeID < 1 {
+			writeAuditError(w, http.StatusBadRequest, "invalid request - before_id must be a positive number")
+			return
+		}
+		filter.BeforeID = beforeID
+	}
+
+	events, err := h.repo.List(r.Context(), filter)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error retrieving audit events")
+		writeAuditError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not retrieve audit events")
+		return
+	}
+
+	resp := EventsResponse{ResponseType: "success", Events: events}
+	if len(events) == filter.Limit {
+		resp.NextBeforeID = &events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
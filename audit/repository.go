@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Filter narrows the listed events, zero values do not filter. Events are listed newest
+// first, BeforeID continues the listing after the last event of the previous page.
+type Filter struct {
+	ActorUserID  *int
+	Action       string
+	ResourceType string
+	ResourceID   string
+	From         *time.Time
+	To           *time.Time
+	BeforeID     int64
+	Limit        int
+}
+
+type Repository interface {
+	Insert(ctx context.Context, event *Event) error
+	List(ctx context.Context, filter Filter) ([]Event, error)
+}
+
+type PgRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPgRepository(db *pgxpool.Pool) *PgRepository {
+	return &PgRepository{db: db}
+}
+
+func (r *PgRepository) Insert(ctx context.Context, event *Event) error {
+	args := pgx.NamedArgs{
+		"actorUserID":  event.ActorUserID,
+		"action":       event.Action,
+		"resourceType": event.ResourceType,
+		"resourceID":   event.ResourceID,
+		"changes":      event.Changes,
+		"metadata":     event.Metadata,
+		"requestID":    event.RequestID,
+		"ip":           event.IP,
+	}
+	query := `INSERT INTO audit_events (actor_user_id, action, resource_type, resource_id, changes, metadata, request_id, ip)
+		VALUES (@actorUserID, @action, @resourceType, @resourceID, @changes, @metadata, @requestID, @ip)
+		RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, query, args).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("unable to insert audit event: %w", err)
+	}
+	return nil
+}
+
+func (r *PgRepository) List(ctx context.Context, filter Filter) ([]Event, error) {
+	args := pgx.NamedArgs{"limit": filter.Limit}
+	var conditions []string
+	if filter.ActorUserID != nil {
+		conditions = append(conditions, "actor_user_id = @actorUserID")
+		args["actorUserID"] = *filter.ActorUserID
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = @action")
+		args["action"] = filter.Action
+	}
+	if filter.ResourceType != "" {
+		conditions = append(conditions, "resource_type = @resourceType")
+		args["resourceType"] = filter.ResourceType
+	}
+	if filter.ResourceID != "" {
+		conditions = append(conditions, "resource_id = @resourceID")
+		args["resourceID"] = filter.ResourceID
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= @from")
+		args["from"] = *filter.From
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at < @to")
+		args["to"] = *filter.To
+	}
+	if filter.BeforeID > 0 {
+		conditions = append(conditions, "id < @beforeID")
+		args["beforeID"] = filter.BeforeID
+	}
+
+	query := `SELECT id, actor_user_id, action, resource_type, resource_id, changes, metadata, request_id, ip, created_at
+		FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT @limit"
+
+	rows, err := r.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		err = rows.Scan(&event.ID, &event.ActorUserID, &event.Action, &event.ResourceType, &event.ResourceID,
+			&event.Changes, &event.Metadata, &event.RequestID, &event.IP, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan audit event row: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during row iteration: %w", err)
+	}
+	return events, nil
+}
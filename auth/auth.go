@@ -1,32 +1,43 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
 
-	"github.com/google/uuid"
 	"golang.org/x/crypto/argon2"
 )
 
 // code from: https://www.alexedwards.net/blog/how-to-hash-and-verify-passwords-with-argon2-in-go
-type params struct {
-	memory      uint32
-	iterations  uint32
-	parallelism uint8
-	saltLength  uint32
-	keyLength   uint32
+type Params struct {
+	// in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
 }
 
-var defaultParams = params{
-	memory:      64 * 1024,
-	iterations:  3,
-	parallelism: 2,
-	saltLength:  16,
-	keyLength:   32,
+var defaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// currentParams are used for new hashes, stored hashes keep the params they were created with
+var currentParams = defaultParams
+
+// SetParams changes the params used for new hashes, it must be called before serving requests.
+func SetParams(p Params) {
+	currentParams = p
 }
 
 var (
@@ -34,27 +45,58 @@ var (
 	ErrIncompatibleVersion = errors.New("incompatible version of argon2")
 )
 
-func GenerateSessionToken() string {
-	return uuid.New().String()
+// GenerateSessionToken returns 256 random bits, url safe encoded. Only the client gets the
+// token, the database keeps HashToken of it.
+func GenerateSessionToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// GenerateAPIKey returns a new api key and its prefix. The prefix is stored in plain text
+// so users can tell their keys apart, the key itself only as HashToken.
+func GenerateAPIKey() (key string, prefix string, err error) {
+	token, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	key = "gr_" + token
+	return key, key[:11], nil
+}
+
+// HashToken returns the hex encoded SHA-256 of a session, refresh or api key token. Tokens are
+// random and long, so unlike passwords they need no salt or slow hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func HashPassword(plainPassword string) (hashedPassword string, err error) {
+func HashPassword(ctx context.Context, plainPassword string) (hashedPassword string, err error) {
+	release, err := acquireHashingSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
 
-	salt := make([]byte, defaultParams.saltLength)
+	p := currentParams
+	salt := make([]byte, p.SaltLength)
 	// fmt.Printf("salt1: %v\n", salt)
 	rand.Read(salt)
 	// fmt.Printf("salt2: %v\n", salt)
-	hashBytes := argon2.IDKey([]byte(plainPassword), salt, defaultParams.iterations, defaultParams.memory, defaultParams.parallelism, defaultParams.keyLength)
+	hashBytes := argon2.IDKey([]byte(plainPassword), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
 	// fmt.Printf("hashBytes: %v\n)", hashBytes)
 	b64Salt := base64.RawStdEncoding.EncodeToString(salt)
 	b64Hash := base64.RawStdEncoding.EncodeToString(hashBytes)
-	hashedPassword = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, defaultParams.memory, defaultParams.iterations, defaultParams.parallelism, b64Salt, b64Hash)
+	hashedPassword = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64Salt, b64Hash)
 	// fmt.Printf("hashedPassword: %v\n", hashedPassword)
 	return hashedPassword, nil
 
 }
 
-func ComparePasswordAndHash(password, encodedHash string) (match bool, err error) {
+func ComparePasswordAndHash(ctx context.Context, password, encodedHash string) (match bool, err error) {
 	// Extract the parameters, salt and derived key from the encoded password
 	// hash.
 	p, salt, hash, err := decodeHash(encodedHash)
@@ -62,8 +104,14 @@ func ComparePasswordAndHash(password, encodedHash string) (match bool, err error
 		return false, err
 	}
 
+	release, err := acquireHashingSlot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
 	// Derive the key from the other password using the same parameters.
-	otherHash := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	otherHash := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
 
 	// Check that the contents of the hashed passwords are identical. Note
 	// that we are using the subtle.ConstantTimeCompare() function for this
@@ -74,7 +122,22 @@ func ComparePasswordAndHash(password, encodedHash string) (match bool, err error
 	return false, nil
 }
 
-func decodeHash(encodedHash string) (p *params, salt, hash []byte, err error) {
+// NeedsRehash reports whether the hash was created with weaker params than the current ones,
+// the password should then be hashed again the next time it is available in plain text.
+// Hashes stronger than the current params are kept, lowering the config never downgrades them.
+func NeedsRehash(encodedHash string) (bool, error) {
+	p, _, _, err := decodeHash(encodedHash)
+	if err != nil {
+		return false, err
+	}
+	return p.Memory < currentParams.Memory ||
+		p.Iterations < currentParams.Iterations ||
+		p.Parallelism < currentParams.Parallelism ||
+		p.SaltLength < currentParams.SaltLength ||
+		p.KeyLength < currentParams.KeyLength, nil
+}
+
+func decodeHash(encodedHash string) (p *Params, salt, hash []byte, err error) {
 	vals := strings.Split(encodedHash, "$")
 	if len(vals) != 6 {
 		return nil, nil, nil, ErrInvalidHash
@@ -89,8 +152,8 @@ func decodeHash(encodedHash string) (p *params, salt, hash []byte, err error) {
 		return nil, nil, nil, ErrIncompatibleVersion
 	}
 
-	p = &params{}
-	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	p = &Params{}
+	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -99,13 +162,13 @@ func decodeHash(encodedHash string) (p *params, salt, hash []byte, err error) {
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	p.saltLength = uint32(len(salt))
+	p.SaltLength = uint32(len(salt))
 
 	hash, err = base64.RawStdEncoding.Strict().DecodeString(vals[5])
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	p.keyLength = uint32(len(hash))
+	p.KeyLength = uint32(len(hash))
 
 	return p, salt, hash, nil
 }
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//go:embed breached_passwords.txt
+var bundledBreachedPasswords []byte
+
+// BreachedPasswords is an offline set of compromised passwords, stored as SHA-1 hashes
+// so lists in the Have I Been Pwned format can be used directly.
+type BreachedPasswords struct {
+	hashes map[[sha1.Size]byte]struct{}
+}
+
+// LoadBreachedPasswords reads the bundled list and, when path is not empty, the list in path.
+// Each line holds one hex encoded SHA-1 hash optionally followed by ":count", lines starting with # are skipped.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	b := &BreachedPasswords{hashes: make(map[[sha1.Size]byte]struct{})}
+
+	err := b.read(bytes.NewReader(bundledBreachedPasswords))
+	if err != nil {
+		return nil, fmt.Errorf("could not read bundled breached passwords: %w", err)
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		err = b.read(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read breached passwords from %s: %w", path, err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *BreachedPasswords) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexHash, _, _ := strings.Cut(line, ":")
+		decoded, err := hex.DecodeString(hexHash)
+		if err != nil || len(decoded) != sha1.Size {
+			return fmt.Errorf("line %d is not a SHA-1 hash", lineNumber)
+		}
+		b.hashes[[sha1.Size]byte(decoded)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	_, found := b.hashes[sha1.Sum([]byte(password))]
+	return found
+}
+
+func (b *BreachedPasswords) Len() int {
+	return len(b.hashes)
+}
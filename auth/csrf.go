@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// CSRFToken derives the CSRF token of a session from the session token, so it needs no
+// storage and changes with the session. The session token is the HMAC key, the token
+// reveals nothing about it and differs from the stored HashToken value.
+func CSRFToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func ValidCSRFToken(sessionToken string, csrfToken string) bool {
+	return hmac.Equal([]byte(CSRFToken(sessionToken)), []byte(csrfToken))
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/defilippomattia/gorest/metrics"
+)
+
+// ErrHashingBusy is returned when no hashing slot frees up within the queue timeout,
+// handlers answer it with 503 and a Retry-After of HashingRetryAfter.
+var ErrHashingBusy = errors.New("too many password hashing operations in progress")
+
+// every argon2 call allocates Params.Memory, the slots bound how much of it is in use at once
+var (
+	hashingSlots        chan struct{}
+	hashingQueueTimeout time.Duration
+)
+
+// HashingRetryAfter is the suggested wait for clients that got ErrHashingBusy
+var HashingRetryAfter = time.Second
+
+// SetConcurrency limits the number of concurrent argon2 calls, callers wait at most
+// queueTimeout for a free slot. maxConcurrent 0 removes the limit. It must be called before serving requests.
+func SetConcurrency(maxConcurrent int, queueTimeout time.Duration) {
+	if maxConcurrent <= 0 {
+		hashingSlots = nil
+		return
+	}
+	hashingSlots = make(chan struct{}, maxConcurrent)
+	hashingQueueTimeout = queueTimeout
+	HashingRetryAfter = max(queueTimeout.Round(time.Second), time.Second)
+}
+
+func acquireHashingSlot(ctx context.Context) (release func(), err error) {
+	if hashingSlots == nil {
+		return func() {}, nil
+	}
+
+	//a free slot is taken right away, even with a zero queue timeout that would otherwise race it
+	select {
+	case hashingSlots <- struct{}{}:
+		metrics.HashingQueueWait.Observe(0)
+		return func() { <-hashingSlots }, nil
+	default:
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(hashingQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case hashingSlots <- struct{}{}:
+		metrics.HashingQueueWait.Observe(time.Since(start).Seconds())
+		return func() { <-hashingSlots }, nil
+	case <-timer.C:
+		metrics.HashingRejectedTotal.Inc()
+		return nil, ErrHashingBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidAccessToken = errors.New("access token is invalid or expired")
+
+// SigningKey is one entry of the key set. HS256 keys only set Secret, EdDSA keys set
+// PrivateKey, or only PublicKey for retired keys that may still verify unexpired tokens.
+type SigningKey struct {
+	ID         string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// TokenIssuer signs short lived access tokens with the active key and verifies tokens
+// signed by any key of the set, so keys can be rotated by adding a new key, making it
+// active and removing the old one once its tokens expired.
+type TokenIssuer struct {
+	method      jwt.SigningMethod
+	issuer      string
+	ttl         time.Duration
+	activeKeyID string
+	keys        map[string]SigningKey
+}
+
+// NewTokenIssuer accepts "HS256" and "EdDSA" as algorithm.
+func NewTokenIssuer(algorithm string, issuer string, ttl time.Duration, activeKeyID string, keys []SigningKey) (*TokenIssuer, error) {
+	var method jwt.SigningMethod
+	switch algorithm {
+	case "HS256":
+		method = jwt.SigningMethodHS256
+	case "EdDSA":
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", algorithm)
+	}
+
+	t := &TokenIssuer{
+		method:      method,
+		issuer:      issuer,
+		ttl:         ttl,
+		activeKeyID: activeKeyID,
+		keys:        make(map[string]SigningKey),
+	}
+	for _, key := range keys {
+		if algorithm == "HS256" && len(key.Secret) < 32 {
+			return nil, fmt.Errorf("jwt key %q: HS256 secrets must be at least 32 bytes", key.ID)
+		}
+		if algorithm == "EdDSA" && key.PrivateKey == nil && key.PublicKey == nil {
+			return nil, fmt.Errorf("jwt key %q: EdDSA keys need a private or public key", key.ID)
+		}
+		if key.PrivateKey != nil && key.PublicKey == nil {
+			key.PublicKey = key.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		t.keys[key.ID] = key
+	}
+
+	active, ok := t.keys[activeKeyID]
+	if !ok {
+		return nil, fmt.Errorf("active jwt key %q is not in the key set", activeKeyID)
+	}
+	if algorithm == "EdDSA" && active.PrivateKey == nil {
+		return nil, fmt.Errorf("active jwt key %q has no private key", activeKeyID)
+	}
+	return t, nil
+}
+
+func (t *TokenIssuer) TTL() time.Duration {
+	return t.ttl
+}
+
+// IssueAccessToken returns a signed token for the user and its expiry.
+func (t *TokenIssuer) IssueAccessToken(userID int) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(t.ttl)
+	claims := jwt.RegisteredClaims{
+		Issuer:    t.issuer,
+		Subject:   strconv.Itoa(userID),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+
+	token := jwt.NewWithClaims(t.method, claims)
+	token.Header["kid"] = t.activeKeyID
+
+	key := t.keys[t.activeKeyID]
+	var signingKey interface{} = key.Secret
+	if t.method == jwt.SigningMethodEdDSA {
+		signingKey = key.PrivateKey
+	}
+
+	signed, err := token.SignedString(signingKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ValidateAccessToken checks signature, issuer and expiry and returns the user id of the token.
+func (t *TokenIssuer) ValidateAccessToken(tokenString string) (int, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, t.verificationKey,
+		jwt.WithValidMethods([]string{t.method.Alg()}),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInvalidAccessToken, err)
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return -1, fmt.Errorf("%w: subject is not a user id", ErrInvalidAccessToken)
+	}
+	return userID, nil
+}
+
+func (t *TokenIssuer) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := t.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if t.method == jwt.SigningMethodEdDSA {
+		return key.PublicKey, nil
+	}
+	return key.Secret, nil
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func hs256Key(id string) SigningKey {
+	return SigningKey{ID: id, Secret: []byte(strings.Repeat(id, 32))}
+}
+
+func newTestIssuer(t *testing.T, algorithm string, ttl time.Duration, activeKeyID string, keys ...SigningKey) *TokenIssuer {
+	t.Helper()
+	issuer, err := NewTokenIssuer(algorithm, "gorest", ttl, activeKeyID, keys)
+	if err != nil {
+		t.Fatalf("NewTokenIssuer() error = %v", err)
+	}
+	return issuer
+}
+
+func issueTestToken(t *testing.T, issuer *TokenIssuer) string {
+	t.Helper()
+	token, _, err := issuer.IssueAccessToken(42)
+	if err != nil {
+		t.Fatalf("IssueAccessToken() error = %v", err)
+	}
+	return token
+}
+
+func TestAccessTokenRoundTrip(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	issuers := map[string]*TokenIssuer{
+		"HS256": newTestIssuer(t, "HS256", time.Minute, "a", hs256Key("a")),
+		"EdDSA": newTestIssuer(t, "EdDSA", time.Minute, "a", SigningKey{ID: "a", PrivateKey: private}),
+	}
+	for algorithm, issuer := range issuers {
+		userID, err := issuer.ValidateAccessToken(issueTestToken(t, issuer))
+		if err != nil || userID != 42 {
+			t.Errorf("%s: ValidateAccessToken() = %d, %v, want 42, nil", algorithm, userID, err)
+		}
+	}
+}
+
+func TestAccessTokenRejected(t *testing.T) {
+	issuer := newTestIssuer(t, "HS256", time.Minute, "a", hs256Key("a"))
+	otherIssuer, err := NewTokenIssuer("HS256", "someone-else", time.Minute, "a", []SigningKey{hs256Key("a")})
+	if err != nil {
+		t.Fatalf("NewTokenIssuer() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{
+			name:  "expired",
+			token: issueTestToken(t, newTestIssuer(t, "HS256", -time.Minute, "a", hs256Key("a"))),
+		},
+		{
+			name:  "wrong key with the same id",
+			token: issueTestToken(t, newTestIssuer(t, "HS256", time.Minute, "a", SigningKey{ID: "a", Secret: []byte(strings.Repeat("x", 32))})),
+		},
+		{
+			name:  "unknown key id",
+			token: issueTestToken(t, newTestIssuer(t, "HS256", time.Minute, "b", hs256Key("b"))),
+		},
+		{
+			name:  "other issuer",
+			token: issueTestToken(t, otherIssuer),
+		},
+		{
+			name:  "tampered payload",
+			token: tamper(issueTestToken(t, issuer)),
+		},
+		{
+			name:  "not a jwt",
+			token: "not-a-jwt",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userID, err := issuer.ValidateAccessToken(test.token)
+			if !errors.Is(err, ErrInvalidAccessToken) {
+				t.Errorf("ValidateAccessToken() = %d, %v, want %v", userID, err, ErrInvalidAccessToken)
+			}
+		})
+	}
+}
+
+// tamper swaps the subject of the token and keeps the signature.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	claims := jwt.MapClaims{"iss": "gorest", "sub": "1", "exp": time.Now().Add(time.Minute).Unix()}
+	payload, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SigningString()
+	parts[1] = strings.Split(payload, ".")[1]
+	return strings.Join(parts, ".")
+}
+
+func TestAccessTokenKeyRotation(t *testing.T) {
+	old := hs256Key("old")
+	next := hs256Key("new")
+	before := newTestIssuer(t, "HS256", time.Minute, "old", old)
+	oldToken := issueTestToken(t, before)
+
+	//the new key is active, the old one still verifies its unexpired tokens
+	during := newTestIssuer(t, "HS256", time.Minute, "new", old, next)
+	newToken := issueTestToken(t, during)
+	for name, token := range map[string]string{"old kid": oldToken, "new kid": newToken} {
+		if _, err := during.ValidateAccessToken(token); err != nil {
+			t.Errorf("%s during rotation: ValidateAccessToken() error = %v", name, err)
+		}
+	}
+	if _, err := before.ValidateAccessToken(newToken); !errors.Is(err, ErrInvalidAccessToken) {
+		t.Errorf("token of the new key accepted by the old key set, error = %v", err)
+	}
+
+	//the old key is removed once its tokens expired
+	after := newTestIssuer(t, "HS256", time.Minute, "new", next)
+	if _, err := after.ValidateAccessToken(oldToken); !errors.Is(err, ErrInvalidAccessToken) {
+		t.Errorf("old kid after rotation: ValidateAccessToken() error = %v, want %v", err, ErrInvalidAccessToken)
+	}
+	if _, err := after.ValidateAccessToken(newToken); err != nil {
+		t.Errorf("new kid after rotation: ValidateAccessToken() error = %v", err)
+	}
+}
+
+func TestAccessTokenAlgorithmConfusion(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	issuer := newTestIssuer(t, "EdDSA", time.Minute, "a", SigningKey{ID: "a", PrivateKey: private})
+	claims := jwt.RegisteredClaims{
+		Issuer:    "gorest",
+		Subject:   "42",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	//the public key is known to everyone, used as HMAC secret it must not verify
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hmacToken.Header["kid"] = "a"
+	forged, err := hmacToken.SignedString([]byte(public))
+	if err != nil {
+		t.Fatalf("signing forged token: %v", err)
+	}
+	if _, err := issuer.ValidateAccessToken(forged); !errors.Is(err, ErrInvalidAccessToken) {
+		t.Errorf("HS256 token signed with the public key: error = %v, want %v", err, ErrInvalidAccessToken)
+	}
+
+	noneToken := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	noneToken.Header["kid"] = "a"
+	unsigned, err := noneToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("building unsigned token: %v", err)
+	}
+	if _, err := issuer.ValidateAccessToken(unsigned); !errors.Is(err, ErrInvalidAccessToken) {
+		t.Errorf("unsigned token: error = %v, want %v", err, ErrInvalidAccessToken)
+	}
+}
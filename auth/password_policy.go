@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type PasswordPolicy struct {
+	// counted in characters
+	MinLength int
+	// counted in bytes, bounds the work done by argon2 for a single request
+	MaxLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	// rejects passwords that contain the username or the local part of the email (or the
+	// other way around), also reversed
+	RejectUsernameSimilarity bool
+	// nil disables the breached password check
+	Breached *BreachedPasswords
+}
+
+// Validate returns one message per violated rule, an empty result means the password is accepted.
+// email may be empty.
+func (p *PasswordPolicy) Validate(password string, username string, email string) []string {
+	var violations []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("password must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("password must be at most %d bytes long", p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUppercase && !hasUpper {
+		violations = append(violations, "password must contain an uppercase letter")
+	}
+	if p.RequireLowercase && !hasLower {
+		violations = append(violations, "password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, "password must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, "password must contain a symbol")
+	}
+
+	if p.RejectUsernameSimilarity && similarToUsername(password, username) {
+		violations = append(violations, "password must not be similar to the username")
+	}
+	localPart, _, _ := strings.Cut(email, "@")
+	if p.RejectUsernameSimilarity && localPart != "" && similarToUsername(password, localPart) {
+		violations = append(violations, "password must not be similar to the email")
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, "password appears in a list of compromised passwords, choose a different one")
+	}
+
+	return violations
+}
+
+func similarToUsername(password string, username string) bool {
+	password = strings.ToLower(password)
+	username = strings.ToLower(username)
+	//very short usernames would match too many passwords by accident
+	if utf8.RuneCountInString(username) < 3 {
+		return password == username
+	}
+	return strings.Contains(password, username) ||
+		strings.Contains(password, reverse(username)) ||
+		strings.Contains(username, password)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	breached, err := LoadBreachedPasswords("")
+	if err != nil {
+		t.Fatalf("loading bundled breached passwords: %v", err)
+	}
+	policy := &PasswordPolicy{
+		MinLength:                8,
+		MaxLength:                16,
+		RejectUsernameSimilarity: true,
+		Breached:                 breached,
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		username string
+		email    string
+		want     []string
+	}{
+		{name: "accepted", password: "correct horse", username: "alice", email: "alice@example.com"},
+		{name: "too short", password: "k7#pQ2x", username: "alice", want: []string{"password must be at least 8 characters long"}},
+		{name: "length counts characters", password: "ääääääää", username: "alice"},
+		{name: "too long in bytes", password: "äääääääää", username: "alice", want: []string{"password must be at most 16 bytes long"}},
+		{name: "contains username", password: "xx-Alice-2024", username: "alice", want: []string{"password must not be similar to the username"}},
+		{name: "contains reversed username", password: "ecila-2024!", username: "alice", want: []string{"password must not be similar to the username"}},
+		{name: "inside username", password: "bobbytables", username: "little-bobbytables", want: []string{"password must not be similar to the username"}},
+		{name: "short username only matches exactly", password: "jo-the-great", username: "jo"},
+		{name: "contains email local part", password: "MrAnderson99", username: "neo", email: "mranderson@example.com", want: []string{"password must not be similar to the email"}},
+		{name: "email domain is not checked", password: "example-rocks", username: "neo", email: "neo@example.com"},
+		{name: "breached", password: "password", username: "alice", want: []string{"password appears in a list of compromised passwords, choose a different one"}},
+		{name: "every violation is listed", password: "alice", username: "alice", want: []string{
+			"password must be at least 8 characters long",
+			"password must not be similar to the username",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := policy.Validate(test.password, test.username, test.email)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Validate(%q, %q, %q) = %q, want %q", test.password, test.username, test.email, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyCharacterClasses(t *testing.T) {
+	policy := &PasswordPolicy{RequireUppercase: true, RequireLowercase: true, RequireDigit: true, RequireSymbol: true}
+
+	tests := []struct {
+		password string
+		want     []string
+	}{
+		{password: "Abc1!"},
+		{password: "Äbç1 "},
+		{password: "abc1!", want: []string{"password must contain an uppercase letter"}},
+		{password: "ABC1!", want: []string{"password must contain a lowercase letter"}},
+		{password: "Abcd!", want: []string{"password must contain a digit"}},
+		{password: "Abc12", want: []string{"password must contain a symbol"}},
+		{password: "", want: []string{
+			"password must contain an uppercase letter",
+			"password must contain a lowercase letter",
+			"password must contain a digit",
+			"password must contain a symbol",
+		}},
+	}
+	for _, test := range tests {
+		got := policy.Validate(test.password, "", "")
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Validate(%q) = %q, want %q", test.password, got, test.want)
+		}
+	}
+}
+
+func TestLoadBreachedPasswordsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	sum := sha1.Sum([]byte("not-in-the-bundled-list"))
+	err := os.WriteFile(path, []byte("# comment\n\n"+hex.EncodeToString(sum[:])+":42\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing list: %v", err)
+	}
+	breached, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatalf("LoadBreachedPasswords() error = %v", err)
+	}
+	if !breached.Contains("not-in-the-bundled-list") {
+		t.Error("password of the file list is not contained")
+	}
+	if !breached.Contains("password") {
+		t.Error("bundled list is not loaded next to the file")
+	}
+	bundled, _ := LoadBreachedPasswords("")
+	if breached.Len() != bundled.Len()+1 {
+		t.Errorf("Len() = %d, want the bundled %d plus 1", breached.Len(), bundled.Len())
+	}
+
+	err = os.WriteFile(path, []byte("not-a-hash\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing list: %v", err)
+	}
+	_, err = LoadBreachedPasswords(path)
+	if err == nil {
+		t.Error("LoadBreachedPasswords() accepted a line that is not a hash")
+	}
+}
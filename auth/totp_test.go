@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// the shared secret of the RFC 4226 and RFC 6238 test vectors
+const rfcSecret = "12345678901234567890"
+
+func TestHOTPRFC4226Vectors(t *testing.T) {
+	//RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := totpCode([]byte(rfcSecret), int64(counter)); got != code {
+			t.Errorf("totpCode(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTPRFC6238Vectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfcSecret))
+	//RFC 6238 appendix B, SHA1. The vectors have 8 digits, a 6 digit code is their last 6
+	tests := []struct {
+		unix int64
+		code string
+		step int64
+	}{
+		{unix: 59, code: "287082", step: 0x1},
+		{unix: 1111111109, code: "081804", step: 0x23523EC},
+		{unix: 1111111111, code: "050471", step: 0x23523ED},
+		{unix: 1234567890, code: "005924", step: 0x273EF07},
+		{unix: 2000000000, code: "279037", step: 0x3F940AA},
+		{unix: 20000000000, code: "353130", step: 0x27BC86AA},
+	}
+	for _, test := range tests {
+		step, ok := ValidateTOTP(secret, test.code, time.Unix(test.unix, 0))
+		if !ok || step != test.step {
+			t.Errorf("ValidateTOTP(%s at %d) = %d, %v, want %d, true", test.code, test.unix, step, ok, test.step)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfcSecret))
+	//59 is in step 1, the codes of the RFC 4226 counters are the codes of the steps
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+		step   int64
+	}{
+		{name: "current step", secret: secret, code: "287082", ok: true, step: 1},
+		{name: "previous step", secret: secret, code: "755224", ok: true, step: 0},
+		{name: "next step", secret: secret, code: "359152", ok: true, step: 2},
+		{name: "two steps ahead", secret: secret, code: "969429"},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "287082", ok: true, step: 1},
+		{name: "wrong code", secret: secret, code: "123456"},
+		{name: "too short", secret: secret, code: "28708"},
+		{name: "too long", secret: secret, code: "2870820"},
+		{name: "secret is not base32", secret: "not base32!", code: "287082"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(test.secret, test.code, now)
+			if ok != test.ok || step != test.step {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, %v", step, ok, test.step, test.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() error = %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q does not decode to 20 bytes: %v", secret, err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes() error = %v", err)
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("recovery code %q is not formatted as xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("recovery code %q generated twice", code)
+		}
+		seen[code] = true
+		if got := NormalizeRecoveryCode(" " + code[:5] + code[6:] + " "); got != code {
+			t.Errorf("NormalizeRecoveryCode() without dash = %q, want %q", got, code)
+		}
+	}
+	if len(codes) != 10 {
+		t.Errorf("generated %d codes, want 10", len(codes))
+	}
+	if got := NormalizeRecoveryCode("ABCDE-FGHIJ"); got != "abcde-fghij" {
+		t.Errorf("NormalizeRecoveryCode() = %q, want abcde-fghij", got)
+	}
+}
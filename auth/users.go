@@ -2,10 +2,10 @@ package auth
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/defilippomattia/gorest/apis"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog/log"
 )
@@ -47,26 +47,26 @@ func Register(conn *pgxpool.Pool) func(ctx context.Context, input *struct {
 		} `json:"body"`
 	}) (*UserOutput, error) {
 		// var username string
-		hashedPassword, err := HashPassword(input.Body.Password)
+		hashedPassword, err := HashPassword(ctx, input.Body.Password)
 		if err != nil {
 			log.Error().Err(err).Msg("error hashing password")
-			return nil, err
+			return nil, apis.HumaError(ctx, err)
 		}
 		var userId int
-		err = conn.QueryRow(context.Background(),
+		err = conn.QueryRow(ctx,
 			"INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id",
 			input.Body.Username, hashedPassword).Scan(&userId)
 		if err != nil {
 			log.Error().Err(err).Msg("error inserting new employee")
-			return nil, err
+			return nil, apis.HumaError(ctx, err)
 		}
-		row := conn.QueryRow(context.Background(),
+		row := conn.QueryRow(ctx,
 			"SELECT id,username,password FROM users WHERE id = $1", userId)
 		var user User
 		err = row.Scan(&user.Id, &user.Username, &user.Password)
 		if err != nil {
 			log.Error().Err(err).Msg("error fetching newly created user")
-			return nil, err
+			return nil, apis.HumaError(ctx, err)
 		}
 		resp := &UserOutput{
 			Body: UserResponse{
@@ -90,27 +90,25 @@ func Login(conn *pgxpool.Pool) func(ctx context.Context, input *struct {
 			Password string `json:"password"`
 		} `json:"body"`
 	}) (*LoginOutput, error) {
-		hashedPassword, err := HashPassword(input.Body.Password)
-		if err != nil {
-			log.Error().Err(err).Msg("error hashing password")
-			return nil, err
-		}
-		fmt.Printf("hashedPassword: %v\n", hashedPassword)
 		var user User
-		err = conn.QueryRow(context.Background(),
+		err := conn.QueryRow(ctx,
 			"SELECT id, username, password FROM users WHERE username = $1", input.Body.Username).Scan(&user.Id, &user.Username, &user.Password)
 		if err != nil {
 			log.Error().Err(err).Msg("error fetching user")
-			return nil, err
+			return nil, apis.HumaError(ctx, err)
 		}
 
-		token := GenerateSessionToken()
+		token, err := GenerateSessionToken()
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("error generating session token")
+			return nil, apis.HumaError(ctx, err)
+		}
 		currentTimestamp := time.Now()
-		_, err = conn.Exec(context.Background(),
-			"INSERT INTO sessions (token, user_id, created_at, last_used) VALUES ($1, $2, $3, $4)", token, user.Id, currentTimestamp, currentTimestamp)
+		_, err = conn.Exec(ctx,
+			"INSERT INTO sessions (token_hash, user_id, created_at, last_used) VALUES ($1, $2, $3, $4)", HashToken(token), user.Id, currentTimestamp, currentTimestamp)
 		if err != nil {
 			log.Error().Err(err).Msg("error inserting new session")
-			return nil, err
+			return nil, apis.HumaError(ctx, err)
 		}
 
 		expiresAt := currentTimestamp.Add(1 * time.Minute)
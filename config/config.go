@@ -3,11 +3,44 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"sort"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 )
 
+type RateLimitPolicy struct {
+	Requests      int `json:"requests" validate:"gt=0"`
+	PeriodSeconds int `json:"period_seconds" validate:"gt=0"`
+	// bucket size, defaults to Requests
+	Burst int    `json:"burst" validate:"gte=0"`
+	KeyBy string `json:"key_by" validate:"oneof=ip user api_key"`
+}
+
+// OIDCProvider is an OpenID Connect provider, its endpoints come from the discovery
+// document at {issuer_url}/.well-known/openid-configuration.
+type OIDCProvider struct {
+	IssuerURL string `json:"issuer_url" validate:"required,url"`
+	ClientID  string `json:"client_id" validate:"required"`
+	// empty for public clients
+	ClientSecret string `json:"client_secret"`
+	// requested in addition to openid
+	Scopes []string `json:"scopes"`
+	// create a user on the first login of an unknown identity, otherwise identities must be linked by a logged in user
+	AutoCreateUsers bool `json:"auto_create_users"`
+}
+
+// JWTKey is one key of the token auth key set, all values are base64 encoded.
+type JWTKey struct {
+	ID string `json:"kid" validate:"required"`
+	// HS256 secret, at least 32 bytes
+	Secret string `json:"secret" validate:"omitempty,base64"`
+	// EdDSA ed25519 seed (32 bytes)
+	PrivateKey string `json:"private_key" validate:"omitempty,base64"`
+	// EdDSA ed25519 public key, for retired keys that only verify tokens
+	PublicKey string `json:"public_key" validate:"omitempty,base64"`
+}
+
 type Config struct {
 	LogLevel string `json:"log_level" validate:"oneof=panic fatal error warn info debug trace"`
 	APIPort  string `json:"api_port" validate:"required"`
@@ -17,7 +50,173 @@ type Config struct {
 		Name     string `json:"name" validate:"required"`
 		Username string `json:"username" validate:"required"`
 		Password string `json:"password" validate:"required"`
+		// deadline for all database work done by one request, 0 disables it
+		QueryTimeoutMs int `json:"query_timeout_ms" validate:"gte=0"`
+		// per route overrides of QueryTimeoutMs, keyed by "METHOD /route/pattern"
+		RouteQueryTimeoutsMs map[string]int `json:"route_query_timeouts_ms" validate:"dive,gte=0"`
 	} `json:"database"`
+	// params for new password hashes, existing hashes are upgraded on the next successful login
+	Argon2 struct {
+		MemoryKiB   uint32 `json:"memory_kib" validate:"gte=8192"`
+		Iterations  uint32 `json:"iterations" validate:"gte=1"`
+		Parallelism uint8  `json:"parallelism" validate:"gte=1"`
+		SaltLength  uint32 `json:"salt_length" validate:"gte=16"`
+		KeyLength   uint32 `json:"key_length" validate:"gte=16"`
+		// concurrent hashing operations, each one allocates memory_kib, 0 removes the limit
+		MaxConcurrency int `json:"max_concurrency" validate:"gte=0"`
+		// how long a request waits for a free slot before getting 503, 0 does not wait
+		QueueTimeoutMs int `json:"queue_timeout_ms" validate:"gte=0"`
+	} `json:"argon2"`
+	PasswordPolicy struct {
+		MinLength int `json:"min_length" validate:"gte=1"`
+		// in bytes, bounds the argon2 work per request
+		MaxLength                int  `json:"max_length" validate:"gtefield=MinLength"`
+		RequireUppercase         bool `json:"require_uppercase"`
+		RequireLowercase         bool `json:"require_lowercase"`
+		RequireDigit             bool `json:"require_digit"`
+		RequireSymbol            bool `json:"require_symbol"`
+		RejectUsernameSimilarity bool `json:"reject_username_similarity"`
+		CheckBreached            bool `json:"check_breached"`
+		// optional list of SHA-1 hashes checked in addition to the bundled one
+		BreachedPasswordsFile string `json:"breached_passwords_file" validate:"omitempty,file"`
+	} `json:"password_policy"`
+	LoginProtection struct {
+		// failed logins for one username before it is locked, 0 disables the lockout
+		MaxFailures int `json:"max_failures" validate:"gte=0"`
+		// failed logins from one ip before it is locked, 0 disables the lockout
+		IPMaxFailures int `json:"ip_max_failures" validate:"gte=0"`
+		// failures older than the window are forgotten
+		FailureWindowSeconds int `json:"failure_window_seconds" validate:"gt=0"`
+		LockoutSeconds       int `json:"lockout_seconds" validate:"gte=0"`
+		// delay before answering a failed login, doubled with every consecutive failure up to MaxDelayMs
+		BaseDelayMs int `json:"base_delay_ms" validate:"gte=0"`
+		MaxDelayMs  int `json:"max_delay_ms" validate:"gtefield=BaseDelayMs"`
+	} `json:"login_protection"`
+	TwoFactor struct {
+		// shown next to the account name in authenticator apps
+		Issuer string `json:"issuer" validate:"required"`
+		// how long the second step of a login may take after the password was verified
+		ChallengeTTLSeconds int `json:"challenge_ttl_seconds" validate:"gte=30"`
+		// wrong codes accepted per login before the password has to be entered again
+		ChallengeMaxAttempts int `json:"challenge_max_attempts" validate:"gte=1"`
+	} `json:"two_factor"`
+	Mail struct {
+		// smtp sends the mails, file appends them to FilePath and log writes them to the log for local testing
+		Sender string `json:"sender" validate:"oneof=smtp file log"`
+		From   string `json:"from" validate:"required,email"`
+		SMTP   struct {
+			Host     string `json:"host"`
+			Port     int    `json:"port" validate:"gte=0,lte=65535"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			StartTLS bool   `json:"start_tls"`
+		} `json:"smtp"`
+		FilePath string `json:"file_path" validate:"required_if=Sender file"`
+		// mails are sent by this many workers after the response, further mails wait in a queue of QueueSize
+		Workers   int `json:"workers" validate:"gte=1"`
+		QueueSize int `json:"queue_size" validate:"gte=1"`
+	} `json:"mail"`
+	PasswordReset struct {
+		TokenTTLSeconds int `json:"token_ttl_seconds" validate:"gte=60"`
+		// page of the frontend that asks for the new password, the token is appended as ?token=
+		URL string `json:"url" validate:"required,url"`
+		// one reset mail per email address within this many seconds
+		MinIntervalSeconds int `json:"min_interval_seconds" validate:"gt=0"`
+	} `json:"password_reset"`
+	EmailVerification struct {
+		TokenTTLSeconds int `json:"token_ttl_seconds" validate:"gte=60"`
+		// link in the mail, usually GET /api/users/verify of this API, the token is appended as ?token=
+		URL string `json:"url" validate:"required,url"`
+		// refuse login until the email is verified, this includes users that registered without email
+		Required bool `json:"required"`
+		// one verification mail per email address within this many seconds
+		MinIntervalSeconds int `json:"min_interval_seconds" validate:"gt=0"`
+	} `json:"email_verification"`
+	OIDC struct {
+		// public url of this API, providers redirect to {redirect_base_url}/api/auth/oidc/{provider}/callback
+		RedirectBaseURL string `json:"redirect_base_url" validate:"required_with=Providers,omitempty,url"`
+		// keyed by the name used in the login and callback urls
+		Providers map[string]OIDCProvider `json:"providers" validate:"dive,keys,max=64,endkeys"`
+	} `json:"oidc"`
+	// optional auth mode where login returns a signed access token and a refresh token
+	TokenAuth struct {
+		Enabled                bool   `json:"enabled"`
+		Algorithm              string `json:"algorithm" validate:"required_if=Enabled true,omitempty,oneof=HS256 EdDSA"`
+		Issuer                 string `json:"issuer"`
+		AccessTokenTTLSeconds  int    `json:"access_token_ttl_seconds" validate:"required_if=Enabled true,gte=0"`
+		RefreshTokenTTLSeconds int    `json:"refresh_token_ttl_seconds" validate:"required_if=Enabled true,gte=0"`
+		// kid of the key signing new tokens, the other keys only verify
+		ActiveKeyID string   `json:"active_kid" validate:"required_if=Enabled true"`
+		Keys        []JWTKey `json:"keys" validate:"dive"`
+	} `json:"token_auth"`
+	RateLimit struct {
+		Enabled bool `json:"enabled"`
+		// memory limits per instance, postgres shares the limits between instances
+		Store string `json:"store" validate:"required_if=Enabled true,omitempty,oneof=memory postgres"`
+		// applied to routes without their own policy, routes are unlimited when missing
+		Default *RateLimitPolicy `json:"default"`
+		// keyed by "METHOD /route/pattern"
+		Routes map[string]RateLimitPolicy `json:"routes" validate:"dive"`
+	} `json:"rate_limit"`
+	Tracing struct {
+		Enabled bool `json:"enabled"`
+		// otlp sends spans over OTLP/HTTP to Endpoint, stdout and file are meant for local testing
+		Exporter string `json:"exporter" validate:"required_if=Enabled true,omitempty,oneof=otlp stdout file"`
+		Endpoint string `json:"endpoint" validate:"required_if=Exporter otlp"`
+		Insecure bool   `json:"insecure"`
+		FilePath string `json:"file_path" validate:"required_if=Exporter file"`
+		// fraction of new traces that are recorded, requests with a sampled parent are always recorded
+		SamplingRatio float64 `json:"sampling_ratio" validate:"gte=0,lte=1"`
+		ServiceName   string  `json:"service_name"`
+	} `json:"tracing"`
+	CORS struct {
+		Enabled bool `json:"enabled"`
+		// exact origins, wildcard subdomain patterns like https://*.example.com or *,
+		// reloaded from the config file on SIGHUP
+		AllowedOrigins   []string `json:"allowed_origins" validate:"dive,required"`
+		AllowedMethods   []string `json:"allowed_methods" validate:"required_if=Enabled true,dive,oneof=GET HEAD POST PUT PATCH DELETE OPTIONS"`
+		AllowedHeaders   []string `json:"allowed_headers"`
+		ExposedHeaders   []string `json:"exposed_headers"`
+		AllowCredentials bool     `json:"allow_credentials"`
+		MaxAgeSeconds    int      `json:"max_age_seconds" validate:"gte=0"`
+	} `json:"cors"`
+	SoftDelete struct {
+		// soft deleted companies and employees are purged for good after this many days, 0 keeps them forever
+		RetentionDays        int `json:"retention_days" validate:"gte=0"`
+		PurgeIntervalSeconds int `json:"purge_interval_seconds" validate:"gt=0"`
+	} `json:"soft_delete"`
+	Concurrency struct {
+		// PUT, PATCH and DELETE of companies and employees without If-Match are answered with 428,
+		// otherwise If-Match is only checked when sent
+		RequireIfMatch bool `json:"require_if_match"`
+	} `json:"concurrency"`
+	Idempotency struct {
+		// responses of requests sent with an Idempotency-Key are replayed to retries for this long
+		ExpirySeconds int `json:"expiry_seconds" validate:"gt=0"`
+		// a key whose request has not finished after this long is given to the next retry,
+		// the instance running it most likely died. Keep it above the slowest request
+		LockTimeoutSeconds int `json:"lock_timeout_seconds" validate:"gt=0,ltefield=ExpirySeconds"`
+	} `json:"idempotency"`
+	Security struct {
+		// 0 leaves HSTS off, only enable it when the API is served over https
+		HSTSMaxAgeSeconds     int    `json:"hsts_max_age_seconds" validate:"gte=0"`
+		HSTSIncludeSubdomains bool   `json:"hsts_include_subdomains"`
+		ReferrerPolicy        string `json:"referrer_policy" validate:"required"`
+		// CSP of the /docs page, it loads the Stoplight Elements UI from unpkg.com
+		DocsCSP string `json:"docs_csp" validate:"required"`
+		// larger request bodies are answered with 413
+		MaxBodyBytes int64 `json:"max_body_bytes" validate:"gt=0"`
+	} `json:"security"`
+}
+
+// oidcProviderNames keeps the client secrets out of the log.
+func oidcProviderNames(providers map[string]OIDCProvider) []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func printConfig(config Config) {
@@ -29,6 +228,87 @@ func printConfig(config Config) {
 		Str("database.name", config.Database.Name).
 		Str("database.username", config.Database.Username).
 		Str("database.password", "************").
+		Int("database.query_timeout_ms", config.Database.QueryTimeoutMs).
+		Interface("database.route_query_timeouts_ms", config.Database.RouteQueryTimeoutsMs).
+		Uint32("argon2.memory_kib", config.Argon2.MemoryKiB).
+		Uint32("argon2.iterations", config.Argon2.Iterations).
+		Uint8("argon2.parallelism", config.Argon2.Parallelism).
+		Uint32("argon2.salt_length", config.Argon2.SaltLength).
+		Uint32("argon2.key_length", config.Argon2.KeyLength).
+		Int("argon2.max_concurrency", config.Argon2.MaxConcurrency).
+		Int("argon2.queue_timeout_ms", config.Argon2.QueueTimeoutMs).
+		Int("password_policy.min_length", config.PasswordPolicy.MinLength).
+		Int("password_policy.max_length", config.PasswordPolicy.MaxLength).
+		Bool("password_policy.require_uppercase", config.PasswordPolicy.RequireUppercase).
+		Bool("password_policy.require_lowercase", config.PasswordPolicy.RequireLowercase).
+		Bool("password_policy.require_digit", config.PasswordPolicy.RequireDigit).
+		Bool("password_policy.require_symbol", config.PasswordPolicy.RequireSymbol).
+		Bool("password_policy.reject_username_similarity", config.PasswordPolicy.RejectUsernameSimilarity).
+		Bool("password_policy.check_breached", config.PasswordPolicy.CheckBreached).
+		Str("password_policy.breached_passwords_file", config.PasswordPolicy.BreachedPasswordsFile).
+		Int("login_protection.max_failures", config.LoginProtection.MaxFailures).
+		Int("login_protection.ip_max_failures", config.LoginProtection.IPMaxFailures).
+		Int("login_protection.failure_window_seconds", config.LoginProtection.FailureWindowSeconds).
+		Int("login_protection.lockout_seconds", config.LoginProtection.LockoutSeconds).
+		Int("login_protection.base_delay_ms", config.LoginProtection.BaseDelayMs).
+		Int("login_protection.max_delay_ms", config.LoginProtection.MaxDelayMs).
+		Str("two_factor.issuer", config.TwoFactor.Issuer).
+		Int("two_factor.challenge_ttl_seconds", config.TwoFactor.ChallengeTTLSeconds).
+		Int("two_factor.challenge_max_attempts", config.TwoFactor.ChallengeMaxAttempts).
+		Str("mail.sender", config.Mail.Sender).
+		Str("mail.from", config.Mail.From).
+		Str("mail.smtp.host", config.Mail.SMTP.Host).
+		Int("mail.smtp.port", config.Mail.SMTP.Port).
+		Str("mail.smtp.username", config.Mail.SMTP.Username).
+		Str("mail.smtp.password", "************").
+		Bool("mail.smtp.start_tls", config.Mail.SMTP.StartTLS).
+		Str("mail.file_path", config.Mail.FilePath).
+		Int("mail.workers", config.Mail.Workers).
+		Int("mail.queue_size", config.Mail.QueueSize).
+		Int("password_reset.token_ttl_seconds", config.PasswordReset.TokenTTLSeconds).
+		Int("password_reset.min_interval_seconds", config.PasswordReset.MinIntervalSeconds).
+		Str("password_reset.url", config.PasswordReset.URL).
+		Int("email_verification.token_ttl_seconds", config.EmailVerification.TokenTTLSeconds).
+		Str("email_verification.url", config.EmailVerification.URL).
+		Bool("email_verification.required", config.EmailVerification.Required).
+		Int("email_verification.min_interval_seconds", config.EmailVerification.MinIntervalSeconds).
+		Str("oidc.redirect_base_url", config.OIDC.RedirectBaseURL).
+		Strs("oidc.providers", oidcProviderNames(config.OIDC.Providers)).
+		Bool("token_auth.enabled", config.TokenAuth.Enabled).
+		Str("token_auth.algorithm", config.TokenAuth.Algorithm).
+		Str("token_auth.issuer", config.TokenAuth.Issuer).
+		Int("token_auth.access_token_ttl_seconds", config.TokenAuth.AccessTokenTTLSeconds).
+		Int("token_auth.refresh_token_ttl_seconds", config.TokenAuth.RefreshTokenTTLSeconds).
+		Str("token_auth.active_kid", config.TokenAuth.ActiveKeyID).
+		Int("token_auth.keys", len(config.TokenAuth.Keys)).
+		Bool("rate_limit.enabled", config.RateLimit.Enabled).
+		Str("rate_limit.store", config.RateLimit.Store).
+		Interface("rate_limit.default", config.RateLimit.Default).
+		Interface("rate_limit.routes", config.RateLimit.Routes).
+		Bool("tracing.enabled", config.Tracing.Enabled).
+		Str("tracing.exporter", config.Tracing.Exporter).
+		Str("tracing.endpoint", config.Tracing.Endpoint).
+		Bool("tracing.insecure", config.Tracing.Insecure).
+		Str("tracing.file_path", config.Tracing.FilePath).
+		Float64("tracing.sampling_ratio", config.Tracing.SamplingRatio).
+		Str("tracing.service_name", config.Tracing.ServiceName).
+		Bool("cors.enabled", config.CORS.Enabled).
+		Strs("cors.allowed_origins", config.CORS.AllowedOrigins).
+		Strs("cors.allowed_methods", config.CORS.AllowedMethods).
+		Strs("cors.allowed_headers", config.CORS.AllowedHeaders).
+		Strs("cors.exposed_headers", config.CORS.ExposedHeaders).
+		Bool("cors.allow_credentials", config.CORS.AllowCredentials).
+		Int("cors.max_age_seconds", config.CORS.MaxAgeSeconds).
+		Int("soft_delete.retention_days", config.SoftDelete.RetentionDays).
+		Int("soft_delete.purge_interval_seconds", config.SoftDelete.PurgeIntervalSeconds).
+		Bool("concurrency.require_if_match", config.Concurrency.RequireIfMatch).
+		Int("idempotency.expiry_seconds", config.Idempotency.ExpirySeconds).
+		Int("idempotency.lock_timeout_seconds", config.Idempotency.LockTimeoutSeconds).
+		Int("security.hsts_max_age_seconds", config.Security.HSTSMaxAgeSeconds).
+		Bool("security.hsts_include_subdomains", config.Security.HSTSIncludeSubdomains).
+		Str("security.referrer_policy", config.Security.ReferrerPolicy).
+		Str("security.docs_csp", config.Security.DocsCSP).
+		Int64("security.max_body_bytes", config.Security.MaxBodyBytes).
 		Msg("")
 }
 
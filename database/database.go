@@ -3,15 +3,24 @@ package database
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog/log"
 )
 
-func ConnectToDatabase(connUrl string) (*pgxpool.Pool, error) {
-	dbpool, err := pgxpool.New(context.Background(), connUrl)
+// ConnectToDatabase creates the connection pool, tracer is called for every query and may be nil.
+func ConnectToDatabase(connUrl string, tracer pgx.QueryTracer) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(connUrl)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to parse database connection url")
+		return nil, err
+	}
+	poolConfig.ConnConfig.Tracer = tracer
+
+	dbpool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		log.Error().Err(err).Msg("unable to create connection pool")
-		return nil, nil
+		return nil, err
 	}
 
 	err = dbpool.Ping(context.Background())
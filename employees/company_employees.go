@@ -0,0 +1,73 @@
+package employees
+
+import (
+	"context"
+	"errors"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+type CompanyEmployeesInput struct {
+	CompanyID      int    `path:"id"`
+	IncludeDeleted bool   `query:"include_deleted" doc:"Also list soft deleted employees, admins only"`
+	Expand         string `query:"expand" enum:"company" doc:"Embed the company of the employees"`
+}
+
+type CompanyEmployeeInput struct {
+	CompanyID int `path:"id"`
+	Body      EmployeeFields
+}
+
+// companyExists fails with 404 when the company does not exist or is deleted.
+func companyExists(ctx context.Context, conn *pgxpool.Pool, companyID int) error {
+	var exists bool
+	err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM companies WHERE id = $1 AND deleted_at IS NULL)", companyID).Scan(&exists)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error checking company")
+		return apis.HumaError(ctx, err)
+	}
+	if !exists {
+		return huma.Error404NotFound("company not found")
+	}
+	return nil
+}
+
+func GetCompanyEmployees(conn *pgxpool.Pool, admins middleware.AdminChecker) func(ctx context.Context, input *CompanyEmployeesInput) (*EmployeesOutput, error) {
+	return func(ctx context.Context, input *CompanyEmployeesInput) (*EmployeesOutput, error) {
+		condition, err := notDeletedCondition(ctx, admins, input.IncludeDeleted)
+		if err != nil {
+			return nil, err
+		}
+		err = companyExists(ctx, conn, input.CompanyID)
+		if err != nil {
+			return nil, err
+		}
+
+		employees, err := queryEmployees(ctx, conn, input.Expand, "e.company_id = $1 AND "+condition, input.CompanyID)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Int("company_id", input.CompanyID).Msg("error fetching employees of company")
+			return nil, apis.HumaError(ctx, err)
+		}
+		resp := &EmployeesOutput{}
+		resp.Body.Employees = employees
+		return resp, nil
+	}
+}
+
+func CreateCompanyEmployee(conn *pgxpool.Pool, auditLog *audit.Recorder) func(ctx context.Context, input *CompanyEmployeeInput) (*EmployeeOutput, error) {
+	return func(ctx context.Context, input *CompanyEmployeeInput) (*EmployeeOutput, error) {
+		employee, err := createEmployee(ctx, conn, auditLog, input.Body, &input.CompanyID)
+		if errors.Is(err, ErrCompanyNotFound) {
+			return nil, huma.Error404NotFound(err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return employeeOutput(employee), nil
+	}
+}
@@ -2,15 +2,24 @@ package employees
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/middleware"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog/log"
 )
 
+// ErrCompanyNotFound is returned when an employee is added to a missing or deleted company.
+var ErrCompanyNotFound = errors.New("company not found")
+
 type Employee struct {
 	ID        int       `json:"id"`
 	FirstName string    `json:"first_name"`
@@ -18,17 +27,161 @@ type Employee struct {
 	Email     string    `json:"email"`
 	Age       int       `json:"age"`
 	CreatedAt time.Time `json:"created_at"`
+	// only set on soft deleted employees, which admins list with include_deleted=true
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	CompanyID *int       `json:"company_id"`
+	// department of the company, set with PUT /api/employees/{id}/department
+	DepartmentID *int `json:"department_id"`
+	// set with PUT /api/employees/{id}/manager, nil for the top of the org chart
+	ManagerID *int `json:"manager_id"`
+	// only set with expand=company
+	Company *EmployeeCompany `json:"company,omitempty"`
+	// bumped on every change and sent as ETag
+	Version int `json:"version"`
 }
 
-type EmployeeInput struct {
+// EmployeeCompany is the company embedded in employees with expand=company.
+type EmployeeCompany struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	YearFounded int    `json:"year_founded"`
+}
+
+// ExpandCompany is the value of the expand query parameter that embeds the company.
+const ExpandCompany = "company"
+
+// employeeQuery selects employees as e joined with their company as c, callers append
+// the WHERE clause and must qualify columns.
+const employeeQuery = `SELECT ` + employeeColumns + `
+	FROM employees e LEFT JOIN companies c ON c.id = e.company_id`
+
+const employeeColumns = `e.id, e.first_name, e.last_name, e.email, e.age, e.created_at, e.deleted_at,
+		e.company_id, e.department_id, e.manager_id, e.version, c.name, c.year_founded`
+
+// scanEmployee scans employeeColumns followed by the columns of extra.
+func scanEmployee(row pgx.Row, employee *Employee, expand string, extra ...any) error {
+	var companyName *string
+	var companyYearFounded *int
+	dest := []any{&employee.ID, &employee.FirstName, &employee.LastName, &employee.Email, &employee.Age, &employee.CreatedAt, &employee.DeletedAt,
+		&employee.CompanyID, &employee.DepartmentID, &employee.ManagerID, &employee.Version, &companyName, &companyYearFounded}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+	if expand == ExpandCompany && employee.CompanyID != nil && companyName != nil {
+		employee.Company = &EmployeeCompany{ID: *employee.CompanyID, Name: *companyName}
+		if companyYearFounded != nil {
+			employee.Company.YearFounded = *companyYearFounded
+		}
+	}
+	return nil
+}
+
+// queryEmployees runs employeeQuery with the WHERE clause where.
+func queryEmployees(ctx context.Context, conn *pgxpool.Pool, expand string, where string, args ...any) ([]Employee, error) {
+	rows, err := conn.Query(ctx, employeeQuery+" WHERE "+where+" ORDER BY e.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	employees := []Employee{}
+	for rows.Next() {
+		var employee Employee
+		err = scanEmployee(rows, &employee, expand)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	return employees, rows.Err()
+}
+
+// getEmployee returns the employee with id, pgx.ErrNoRows when it does not exist or
+// the condition excludes it.
+func getEmployee(ctx context.Context, conn *pgxpool.Pool, id int, condition string, expand string) (*Employee, error) {
+	var employee Employee
+	err := scanEmployee(conn.QueryRow(ctx, employeeQuery+" WHERE e.id = $1 AND "+condition, id), &employee, expand)
+	if err != nil {
+		return nil, err
+	}
+	return &employee, nil
+}
+
+// EmployeeFields are the fields clients set on employees.
+type EmployeeFields struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Email     string `json:"email"`
 	Age       int    `json:"age"`
 }
 
+type EmployeeInput struct {
+	Body struct {
+		EmployeeFields
+		CompanyID *int `json:"company_id,omitempty" doc:"Company the employee works for, it must not be deleted"`
+	}
+}
+
 type EmployeesInput struct {
-	Session http.Cookie `cookie:"session_token"` // Use the correct cookie name here
+	Session        http.Cookie `cookie:"session_token"` // Use the correct cookie name here
+	IncludeDeleted bool        `query:"include_deleted" doc:"Also list soft deleted employees, admins only"`
+	Expand         string      `query:"expand" enum:"company" doc:"Embed the company of the employees"`
+}
+
+type EmployeeByIDInput struct {
+	ID             int    `path:"id"`
+	IncludeDeleted bool   `query:"include_deleted" doc:"Also return a soft deleted employee, admins only"`
+	Expand         string `query:"expand" enum:"company" doc:"Embed the company of the employee"`
+	IfNoneMatch    string `header:"If-None-Match" doc:"ETag of the employee the client has, answered with 304 when it did not change"`
+}
+
+type EmployeeIDInput struct {
+	ID int `path:"id"`
+}
+
+// IfMatchInput is embedded in the input of writes to employees.
+type IfMatchInput struct {
+	IfMatch string `header:"If-Match" doc:"ETag of the employee the change is based on, the change fails with 412 when the employee changed since"`
+}
+
+// expectedVersions fails with 428 when the If-Match header is required but missing.
+func (i *IfMatchInput) expectedVersions(required bool) ([]int, error) {
+	versions, err := apis.ExpectedVersions(i.IfMatch, required)
+	if err != nil {
+		return nil, huma.NewError(http.StatusPreconditionRequired, err.Error())
+	}
+	return versions, nil
+}
+
+type DeleteEmployeeInput struct {
+	ID int `path:"id"`
+	IfMatchInput
+}
+
+// requireUser fails with 401 for anonymous requests, employees are read by anybody
+// but only changed by users.
+func requireUser(ctx context.Context) error {
+	if middleware.GetUserID(ctx) == -1 {
+		return huma.Error401Unauthorized("unauthorized - session token is missing or invalid")
+	}
+	return nil
+}
+
+// notDeletedCondition hides soft deleted employees unless an admin asked for them,
+// it fails with 403 when anybody else asks.
+func notDeletedCondition(ctx context.Context, admins middleware.AdminChecker, includeDeleted bool) (string, error) {
+	if !includeDeleted {
+		return "e.deleted_at IS NULL", nil
+	}
+	isAdmin, err := middleware.IsAdmin(ctx, admins)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error checking admin permission")
+		return "", apis.HumaError(ctx, err)
+	}
+	if !isAdmin {
+		return "", huma.Error403Forbidden("include_deleted requires admin permission")
+	}
+	return "TRUE", nil
 }
 
 type EmployeesOutput struct {
@@ -38,32 +191,36 @@ type EmployeesOutput struct {
 }
 
 type EmployeeOutput struct {
+	ETag string   `header:"ETag"`
 	Body Employee `json:"body"`
 }
 
-func GetEmployees(conn *pgxpool.Pool) func(ctx context.Context, input *EmployeesInput) (*EmployeesOutput, error) {
+func employeeOutput(employee *Employee) *EmployeeOutput {
+	return &EmployeeOutput{ETag: apis.ETag(employee.Version), Body: *employee}
+}
+
+// EmployeeByIDOutput has no body when the client's copy is not modified.
+type EmployeeByIDOutput struct {
+	ETag   string `header:"ETag"`
+	Status int
+	Body   *Employee
+}
+
+func GetEmployees(conn *pgxpool.Pool, admins middleware.AdminChecker) func(ctx context.Context, input *EmployeesInput) (*EmployeesOutput, error) {
 	return func(ctx context.Context, input *EmployeesInput) (*EmployeesOutput, error) {
-		fmt.Printf("session token: %v\n", input.Session.Value)
-		log.Info().
+		log.Ctx(ctx).Info().
 			Str("event", "get.employees").
 			Msg("getting all employees started")
-		rows, err := conn.Query(context.Background(), "SELECT id, first_name, last_name, email, age, created_at FROM employees")
+		condition, err := notDeletedCondition(ctx, admins, input.IncludeDeleted)
 		if err != nil {
-			log.Error().
-				Str("event", "get.employees").
-				Err(err).Msg("error fetching employees")
 			return nil, err
 		}
-		defer rows.Close()
-		var employees []Employee
-		for rows.Next() {
-			var employee Employee
-			err = rows.Scan(&employee.ID, &employee.FirstName, &employee.LastName, &employee.Email, &employee.Age, &employee.CreatedAt)
-			if err != nil {
-				log.Error().Err(err).Msg("error scanning employee")
-				return nil, err
-			}
-			employees = append(employees, employee)
+		employees, err := queryEmployees(ctx, conn, input.Expand, condition)
+		if err != nil {
+			log.Ctx(ctx).Error().
+				Str("event", "get.employees").
+				Err(err).Msg("error fetching employees")
+			return nil, apis.HumaError(ctx, err)
 		}
 		resp := &EmployeesOutput{}
 		resp.Body.Employees = employees
@@ -71,60 +228,245 @@ func GetEmployees(conn *pgxpool.Pool) func(ctx context.Context, input *Employees
 	}
 }
 
-func GetEmployeeById(conn *pgxpool.Pool) func(ctx context.Context, input *struct {
-	ID int `path:"id"`
-}) (*EmployeeOutput, error) {
-	return func(ctx context.Context, input *struct {
-		ID int `path:"id"`
-	}) (*EmployeeOutput, error) {
-		row := conn.QueryRow(context.Background(), "SELECT id, first_name, last_name, email, age, created_at FROM employees WHERE id = $1", input.ID)
-		fmt.Printf("id: %v\n", input.ID)
-		fmt.Printf("row: %v\n", row)
+func GetEmployeeById(conn *pgxpool.Pool, admins middleware.AdminChecker) func(ctx context.Context, input *EmployeeByIDInput) (*EmployeeByIDOutput, error) {
+	return func(ctx context.Context, input *EmployeeByIDInput) (*EmployeeByIDOutput, error) {
+		condition, err := notDeletedCondition(ctx, admins, input.IncludeDeleted)
+		if err != nil {
+			return nil, err
+		}
 
-		var employee Employee
-		err := row.Scan(&employee.ID, &employee.FirstName, &employee.LastName, &employee.Email, &employee.Age, &employee.CreatedAt)
+		employee, err := getEmployee(ctx, conn, input.ID, condition, input.Expand)
 		if err != nil {
 			if err == pgx.ErrNoRows {
-				log.Error().Err(err).Msg("employee not found")
-				return nil, err
+				log.Ctx(ctx).Error().Err(err).Msg("employee not found")
+				return nil, huma.Error404NotFound("employee not found")
 			}
-			log.Error().Err(err).Msg("error fetching employee")
-			return nil, err
+			log.Ctx(ctx).Error().Err(err).Msg("error fetching employee")
+			return nil, apis.HumaError(ctx, err)
 		}
 
-		fmt.Printf("employee: %v\n", employee)
-
-		resp := &EmployeeOutput{
-			Body: employee,
+		resp := &EmployeeByIDOutput{
+			ETag:   apis.ETag(employee.Version),
+			Status: http.StatusOK,
+			Body:   employee,
+		}
+		if apis.NotModified(input.IfNoneMatch, employee.Version) {
+			resp.Status = http.StatusNotModified
+			resp.Body = nil
 		}
 		return resp, nil
 	}
 }
 
-func CreateEmployee(conn *pgxpool.Pool) func(ctx context.Context, input *EmployeeInput) (*EmployeeOutput, error) {
+func CreateEmployee(conn *pgxpool.Pool, auditLog *audit.Recorder) func(ctx context.Context, input *EmployeeInput) (*EmployeeOutput, error) {
 	return func(ctx context.Context, input *EmployeeInput) (*EmployeeOutput, error) {
-		var employeeID int
-		err := conn.QueryRow(context.Background(),
-			"INSERT INTO employees (first_name, last_name, email, age) VALUES ($1, $2, $3, $4) RETURNING id",
-			input.FirstName, input.LastName, input.Email, input.Age).Scan(&employeeID)
+		employee, err := createEmployee(ctx, conn, auditLog, input.Body.EmployeeFields, input.Body.CompanyID)
+		if errors.Is(err, ErrCompanyNotFound) {
+			return nil, huma.Error422UnprocessableEntity(err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return employeeOutput(employee), nil
+	}
+}
+
+// createEmployee inserts the employee, companyID may be nil. Deleted companies do not take
+// new employees, both missing and deleted ones fail with ErrCompanyNotFound.
+func createEmployee(ctx context.Context, conn *pgxpool.Pool, auditLog *audit.Recorder, fields EmployeeFields, companyID *int) (*Employee, error) {
+	employeeID, err := insertEmployee(ctx, conn, fields, companyID)
+	if err != nil {
+		if errors.Is(err, ErrCompanyNotFound) {
+			return nil, err
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, huma.Error409Conflict("another employee uses this email")
+		}
+		log.Ctx(ctx).Error().Err(err).Msg("error inserting new employee")
+		return nil, apis.HumaError(ctx, err)
+	}
+
+	employee, err := getEmployee(ctx, conn, employeeID, "TRUE", "")
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error fetching newly created employee")
+		return nil, apis.HumaError(ctx, err)
+	}
+
+	auditLog.Record(ctx, audit.Event{
+		Action:       audit.ActionCreate,
+		ResourceType: audit.ResourceEmployee,
+		ResourceID:   audit.ResourceID(employee.ID),
+		Changes:      audit.Diff(nil, employee),
+	})
+	return employee, nil
+}
+
+// insertEmployee holds a share lock on the company until the employee is in, a company
+// delete waits for it and then moves the new employee away too.
+func insertEmployee(ctx context.Context, conn *pgxpool.Pool, fields EmployeeFields, companyID *int) (int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(ctx)
 
+	if companyID != nil {
+		var exists int
+		err = tx.QueryRow(ctx, "SELECT 1 FROM companies WHERE id = $1 AND deleted_at IS NULL FOR SHARE", *companyID).Scan(&exists)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return -1, ErrCompanyNotFound
+			}
+			return -1, err
+		}
+	}
+
+	var employeeID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO employees (first_name, last_name, email, age, company_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		fields.FirstName, fields.LastName, fields.Email, fields.Age, companyID).Scan(&employeeID)
+	if err != nil {
+		return -1, err
+	}
+	return employeeID, tx.Commit(ctx)
+}
+
+// DeleteEmployee soft deletes the employee, it stays restorable until the purge job
+// removes it after the retention period.
+func DeleteEmployee(conn *pgxpool.Pool, auditLog *audit.Recorder, requireIfMatch bool) func(ctx context.Context, input *DeleteEmployeeInput) (*struct{}, error) {
+	return func(ctx context.Context, input *DeleteEmployeeInput) (*struct{}, error) {
+		err := requireUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		expectedVersions, err := input.expectedVersions(requireIfMatch)
 		if err != nil {
-			log.Error().Err(err).Msg("error inserting new employee")
 			return nil, err
 		}
 
-		row := conn.QueryRow(context.Background(),
-			"SELECT id, first_name, last_name, email, age, created_at FROM employees WHERE id = $1", employeeID)
-		var employee Employee
-		err = row.Scan(&employee.ID, &employee.FirstName, &employee.LastName, &employee.Email, &employee.Age, &employee.CreatedAt)
+		deletedAt, err := deleteEmployee(ctx, conn, input.ID, expectedVersions)
+		if err != nil {
+			if errors.Is(err, ErrEmployeeNotFound) {
+				return nil, huma.Error404NotFound(err.Error())
+			}
+			if errors.Is(err, apis.ErrPreconditionFailed) {
+				return nil, huma.Error412PreconditionFailed(err.Error())
+			}
+			log.Ctx(ctx).Error().Err(err).Msg("error deleting employee")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		auditLog.Record(ctx, audit.Event{
+			Action:       audit.ActionDelete,
+			ResourceType: audit.ResourceEmployee,
+			ResourceID:   audit.ResourceID(input.ID),
+			Changes:      audit.Diff(nil, map[string]any{"deleted_at": deletedAt}),
+		})
+		return nil, nil
+	}
+}
+
+// deleteEmployee soft deletes the employee, its direct reports move up to its manager so
+// the org chart stays connected. Restoring the employee does not move them back.
+func deleteEmployee(ctx context.Context, conn *pgxpool.Pool, id int, expectedVersions []int) (time.Time, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var version int
+	var managerID *int
+	err = tx.QueryRow(ctx, "SELECT version, manager_id FROM employees WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&version, &managerID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, ErrEmployeeNotFound
+		}
+		return time.Time{}, err
+	}
+	err = apis.CheckVersion(expectedVersions, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var deletedAt time.Time
+	err = tx.QueryRow(ctx, "UPDATE employees SET deleted_at = NOW(), version = version + 1 WHERE id = $1 RETURNING deleted_at", id).Scan(&deletedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE employees SET manager_id = $1, version = version + 1 WHERE manager_id = $2 AND deleted_at IS NULL", managerID, id)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to move reports to the next manager: %w", err)
+	}
+	return deletedAt, tx.Commit(ctx)
+}
+
+// RestoreEmployee undoes a soft delete, admins only.
+func RestoreEmployee(conn *pgxpool.Pool, admins middleware.AdminChecker, auditLog *audit.Recorder) func(ctx context.Context, input *EmployeeIDInput) (*EmployeeOutput, error) {
+	return func(ctx context.Context, input *EmployeeIDInput) (*EmployeeOutput, error) {
+		err := requireUser(ctx)
 		if err != nil {
-			log.Error().Err(err).Msg("error fetching newly created employee")
 			return nil, err
 		}
+		isAdmin, err := middleware.IsAdmin(ctx, admins)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("error checking admin permission")
+			return nil, apis.HumaError(ctx, err)
+		}
+		if !isAdmin {
+			return nil, huma.Error403Forbidden("forbidden - admin permission required")
+		}
 
-		resp := &EmployeeOutput{
-			Body: employee,
+		var companyDeleted bool
+		err = conn.QueryRow(ctx, `SELECT c.deleted_at IS NOT NULL
+			FROM employees e LEFT JOIN companies c ON c.id = e.company_id
+			WHERE e.id = $1 AND e.deleted_at IS NOT NULL`, input.ID).Scan(&companyDeleted)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, huma.Error404NotFound("deleted employee not found")
+			}
+			log.Ctx(ctx).Error().Err(err).Msg("error fetching deleted employee")
+			return nil, apis.HumaError(ctx, err)
 		}
-		return resp, nil
+		if companyDeleted {
+			return nil, huma.Error409Conflict("the company of the employee is deleted, restore it first")
+		}
+
+		tag, err := conn.Exec(ctx, "UPDATE employees SET deleted_at = NULL, version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL", input.ID)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return nil, huma.Error409Conflict("another employee uses the email of the deleted employee")
+			}
+			log.Ctx(ctx).Error().Err(err).Msg("error restoring employee")
+			return nil, apis.HumaError(ctx, err)
+		}
+		if tag.RowsAffected() == 0 {
+			//restored or purged by a concurrent request since the check above
+			return nil, huma.Error404NotFound("deleted employee not found")
+		}
+		employee, err := getEmployee(ctx, conn, input.ID, "TRUE", "")
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("error fetching restored employee")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		auditLog.Record(ctx, audit.Event{
+			Action:       audit.ActionRestore,
+			ResourceType: audit.ResourceEmployee,
+			ResourceID:   audit.ResourceID(employee.ID),
+		})
+		return employeeOutput(employee), nil
+	}
+}
+
+// Purge removes employees soft deleted longer than olderThan ago.
+func Purge(ctx context.Context, conn *pgxpool.Pool, olderThan time.Duration) (int64, error) {
+	tag, err := conn.Exec(ctx, "DELETE FROM employees WHERE deleted_at < NOW() - make_interval(secs => $1)", olderThan.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge employees: %w", err)
 	}
+	return tag.RowsAffected(), nil
 }
@@ -0,0 +1,352 @@
+package employees
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrEmployeeNotFound = errors.New("employee not found")
+
+var ErrManagerNotFound = errors.New("manager not found")
+
+var ErrManagerOtherCompany = errors.New("manager must work for the same company")
+
+var ErrManagerCycle = errors.New("the manager reports to the employee, assigning it would create a cycle")
+
+var ErrDepartmentNotFound = errors.New("department not found")
+
+var ErrDepartmentOtherCompany = errors.New("department belongs to another company")
+
+// all manager assignments take this lock, so two concurrent assignments can not form a
+// cycle that each one alone would not
+const managerLockKey = "employees.manager_id"
+
+// OrgChartEmployee is an employee in reports or a chain, depth is the distance to the
+// employee the org chart was requested for, 1 for direct reports and the direct manager.
+type OrgChartEmployee struct {
+	Employee
+	Depth int `json:"depth"`
+}
+
+type ReportsInput struct {
+	ID        int  `path:"id"`
+	Recursive bool `query:"recursive" doc:"Also list the reports of the reports, down to the bottom of the org chart"`
+}
+
+type ReportsOutput struct {
+	Body struct {
+		Reports []OrgChartEmployee `json:"reports"`
+	}
+}
+
+type ChainOutput struct {
+	Body struct {
+		// nearest manager first, the top of the org chart last
+		Chain []OrgChartEmployee `json:"chain"`
+	}
+}
+
+type ManagerInput struct {
+	ID int `path:"id"`
+	IfMatchInput
+	Body struct {
+		ManagerID *int `json:"manager_id" nullable:"true" doc:"Manager of the employee, null removes the manager"`
+	}
+}
+
+type DepartmentInput struct {
+	ID int `path:"id"`
+	IfMatchInput
+	Body struct {
+		DepartmentID *int `json:"department_id" nullable:"true" doc:"Department of the employee's company, null removes the department"`
+	}
+}
+
+func queryOrgChart(ctx context.Context, conn *pgxpool.Pool, query string, args ...any) ([]OrgChartEmployee, error) {
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	employees := []OrgChartEmployee{}
+	for rows.Next() {
+		var employee OrgChartEmployee
+		err = scanEmployee(rows, &employee.Employee, "", &employee.Depth)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	return employees, rows.Err()
+}
+
+// GetReports lists the employees reporting to the employee, deleted employees and
+// everybody below them are left out.
+func GetReports(conn *pgxpool.Pool) func(ctx context.Context, input *ReportsInput) (*ReportsOutput, error) {
+	return func(ctx context.Context, input *ReportsInput) (*ReportsOutput, error) {
+		_, err := getEmployee(ctx, conn, input.ID, "e.deleted_at IS NULL", "")
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, huma.Error404NotFound(ErrEmployeeNotFound.Error())
+			}
+			log.Ctx(ctx).Error().Err(err).Msg("error fetching employee")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		//path stops the walk should the data ever contain a cycle
+		query := `WITH RECURSIVE reports AS (
+				SELECT id, 1 AS depth, ARRAY[manager_id, id] AS path
+				FROM employees WHERE manager_id = $1 AND deleted_at IS NULL
+			UNION ALL
+				SELECT report.id, reports.depth + 1, reports.path || report.id
+				FROM employees report JOIN reports ON report.manager_id = reports.id
+				WHERE $2::boolean AND report.deleted_at IS NULL AND NOT report.id = ANY(reports.path)
+			)
+			SELECT ` + employeeColumns + `, reports.depth
+			FROM reports JOIN employees e ON e.id = reports.id LEFT JOIN companies c ON c.id = e.company_id
+			ORDER BY reports.depth, e.id`
+		reports, err := queryOrgChart(ctx, conn, query, input.ID, input.Recursive)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Int("employee_id", input.ID).Msg("error fetching reports")
+			return nil, apis.HumaError(ctx, err)
+		}
+		resp := &ReportsOutput{}
+		resp.Body.Reports = reports
+		return resp, nil
+	}
+}
+
+// GetChain lists the managers of the employee up to the top of the org chart.
+func GetChain(conn *pgxpool.Pool) func(ctx context.Context, input *EmployeeIDInput) (*ChainOutput, error) {
+	return func(ctx context.Context, input *EmployeeIDInput) (*ChainOutput, error) {
+		_, err := getEmployee(ctx, conn, input.ID, "e.deleted_at IS NULL", "")
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, huma.Error404NotFound(ErrEmployeeNotFound.Error())
+			}
+			log.Ctx(ctx).Error().Err(err).Msg("error fetching employee")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		query := `WITH RECURSIVE chain AS (
+				SELECT manager.id, 1 AS depth, ARRAY[employee.id, manager.id] AS path
+				FROM employees employee JOIN employees manager ON manager.id = employee.manager_id
+				WHERE employee.id = $1
+			UNION ALL
+				SELECT manager.id, chain.depth + 1, chain.path || manager.id
+				FROM chain JOIN employees step ON step.id = chain.id
+				JOIN employees manager ON manager.id = step.manager_id
+				WHERE NOT manager.id = ANY(chain.path)
+			)
+			SELECT ` + employeeColumns + `, chain.depth
+			FROM chain JOIN employees e ON e.id = chain.id LEFT JOIN companies c ON c.id = e.company_id
+			ORDER BY chain.depth`
+		chain, err := queryOrgChart(ctx, conn, query, input.ID)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Int("employee_id", input.ID).Msg("error fetching management chain")
+			return nil, apis.HumaError(ctx, err)
+		}
+		resp := &ChainOutput{}
+		resp.Body.Chain = chain
+		return resp, nil
+	}
+}
+
+func AssignManager(conn *pgxpool.Pool, auditLog *audit.Recorder, requireIfMatch bool) func(ctx context.Context, input *ManagerInput) (*EmployeeOutput, error) {
+	return func(ctx context.Context, input *ManagerInput) (*EmployeeOutput, error) {
+		err := requireUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		expectedVersions, err := input.expectedVersions(requireIfMatch)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := assignManager(ctx, conn, input.ID, input.Body.ManagerID, expectedVersions)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrEmployeeNotFound):
+				return nil, huma.Error404NotFound(err.Error())
+			case errors.Is(err, apis.ErrPreconditionFailed):
+				return nil, huma.Error412PreconditionFailed(err.Error())
+			case errors.Is(err, ErrManagerNotFound), errors.Is(err, ErrManagerOtherCompany):
+				return nil, huma.Error422UnprocessableEntity(err.Error())
+			case errors.Is(err, ErrManagerCycle):
+				return nil, huma.Error409Conflict(err.Error())
+			}
+			log.Ctx(ctx).Error().Err(err).Int("employee_id", input.ID).Msg("error assigning manager")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		auditLog.Record(ctx, audit.Event{
+			Action:       audit.ActionUpdate,
+			ResourceType: audit.ResourceEmployee,
+			ResourceID:   audit.ResourceID(input.ID),
+			Changes:      audit.Diff(map[string]*int{"manager_id": previous}, map[string]*int{"manager_id": input.Body.ManagerID}),
+		})
+		return updatedEmployee(ctx, conn, input.ID)
+	}
+}
+
+// assignManager sets the manager of the employee and returns the previous one. The manager
+// must work for the same company and must not report to the employee, directly or not.
+func assignManager(ctx context.Context, conn *pgxpool.Pool, employeeID int, managerID *int, expectedVersions []int) (*int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", managerLockKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock manager assignments: %w", err)
+	}
+
+	var companyID, previous *int
+	var version int
+	err = tx.QueryRow(ctx, "SELECT company_id, manager_id, version FROM employees WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", employeeID).
+		Scan(&companyID, &previous, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEmployeeNotFound
+		}
+		return nil, err
+	}
+	err = apis.CheckVersion(expectedVersions, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if managerID != nil {
+		var managerCompanyID *int
+		err = tx.QueryRow(ctx, "SELECT company_id FROM employees WHERE id = $1 AND deleted_at IS NULL", *managerID).Scan(&managerCompanyID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrManagerNotFound
+			}
+			return nil, err
+		}
+		if (companyID == nil) != (managerCompanyID == nil) || (companyID != nil && *companyID != *managerCompanyID) {
+			return nil, ErrManagerOtherCompany
+		}
+
+		//walk up from the new manager, meeting the employee means the manager reports to it
+		var cycle bool
+		err = tx.QueryRow(ctx, `WITH RECURSIVE chain AS (
+				SELECT id, manager_id, ARRAY[id] AS path FROM employees WHERE id = $1
+			UNION ALL
+				SELECT manager.id, manager.manager_id, chain.path || manager.id
+				FROM chain JOIN employees manager ON manager.id = chain.manager_id
+				WHERE NOT manager.id = ANY(chain.path)
+			)
+			SELECT EXISTS (SELECT 1 FROM chain WHERE id = $2)`, *managerID, employeeID).Scan(&cycle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check for reporting cycles: %w", err)
+		}
+		if cycle {
+			return nil, ErrManagerCycle
+		}
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE employees SET manager_id = $1, version = version + 1 WHERE id = $2", managerID, employeeID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update manager: %w", err)
+	}
+	return previous, tx.Commit(ctx)
+}
+
+func AssignDepartment(conn *pgxpool.Pool, auditLog *audit.Recorder, requireIfMatch bool) func(ctx context.Context, input *DepartmentInput) (*EmployeeOutput, error) {
+	return func(ctx context.Context, input *DepartmentInput) (*EmployeeOutput, error) {
+		err := requireUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		expectedVersions, err := input.expectedVersions(requireIfMatch)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := assignDepartment(ctx, conn, input.ID, input.Body.DepartmentID, expectedVersions)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrEmployeeNotFound):
+				return nil, huma.Error404NotFound(err.Error())
+			case errors.Is(err, apis.ErrPreconditionFailed):
+				return nil, huma.Error412PreconditionFailed(err.Error())
+			case errors.Is(err, ErrDepartmentNotFound), errors.Is(err, ErrDepartmentOtherCompany):
+				return nil, huma.Error422UnprocessableEntity(err.Error())
+			}
+			log.Ctx(ctx).Error().Err(err).Int("employee_id", input.ID).Msg("error assigning department")
+			return nil, apis.HumaError(ctx, err)
+		}
+
+		auditLog.Record(ctx, audit.Event{
+			Action:       audit.ActionUpdate,
+			ResourceType: audit.ResourceEmployee,
+			ResourceID:   audit.ResourceID(input.ID),
+			Changes:      audit.Diff(map[string]*int{"department_id": previous}, map[string]*int{"department_id": input.Body.DepartmentID}),
+		})
+		return updatedEmployee(ctx, conn, input.ID)
+	}
+}
+
+// assignDepartment sets the department of the employee and returns the previous one,
+// the department must belong to the company of the employee.
+func assignDepartment(ctx context.Context, conn *pgxpool.Pool, employeeID int, departmentID *int, expectedVersions []int) (*int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var companyID, previous *int
+	var version int
+	err = tx.QueryRow(ctx, "SELECT company_id, department_id, version FROM employees WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", employeeID).
+		Scan(&companyID, &previous, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEmployeeNotFound
+		}
+		return nil, err
+	}
+	err = apis.CheckVersion(expectedVersions, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if departmentID != nil {
+		var departmentCompanyID int
+		err = tx.QueryRow(ctx, "SELECT company_id FROM departments WHERE id = $1", *departmentID).Scan(&departmentCompanyID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrDepartmentNotFound
+			}
+			return nil, err
+		}
+		if companyID == nil || *companyID != departmentCompanyID {
+			return nil, ErrDepartmentOtherCompany
+		}
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE employees SET department_id = $1, version = version + 1 WHERE id = $2", departmentID, employeeID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update department: %w", err)
+	}
+	return previous, tx.Commit(ctx)
+}
+
+func updatedEmployee(ctx context.Context, conn *pgxpool.Pool, id int) (*EmployeeOutput, error) {
+	employee, err := getEmployee(ctx, conn, id, "TRUE", "")
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Int("employee_id", id).Msg("error fetching updated employee")
+		return nil, apis.HumaError(ctx, err)
+	}
+	return employeeOutput(employee), nil
+}
@@ -0,0 +1,58 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Response is what the first request with a key got, retries get the same.
+type Response struct {
+	Status int
+	// only the headers set by the handler, the middleware in front of it sets the rest again
+	Header http.Header
+	Body   []byte
+}
+
+// Record is the earlier request with the same key.
+type Record struct {
+	// hash of the method, path and body of the request
+	Fingerprint string
+	// nil while the earlier request is still in progress
+	Response *Response
+}
+
+// Store keeps the keys of the requests. Keys belong to a scope, the user or client ip,
+// so one client can not replay the responses of another.
+type Store interface {
+	// Begin claims the key for a request with fingerprint. It returns nil when the caller
+	// owns the key and must Complete or Release it, otherwise the record of the earlier
+	// request. Keys older than ttl are claimed again as if they were new, keys still
+	// without a response after lockTimeout too, their request is taken for dead.
+	Begin(ctx context.Context, scope string, key string, fingerprint string, ttl time.Duration, lockTimeout time.Duration) (*Record, error)
+	// Complete stores the response, a key that already has one keeps it
+	Complete(ctx context.Context, scope string, key string, response Response) error
+	// Release gives up the key without a response so a retry runs the request again
+	Release(ctx context.Context, scope string, key string) error
+	// Cleanup removes keys claimed before olderThan, they would be claimed again anyway
+	Cleanup(ctx context.Context, olderThan time.Duration) error
+}
+
+// RunCleanup periodically removes expired keys from the store until ctx is done.
+func RunCleanup(ctx context.Context, store Store, interval time.Duration, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := store.Cleanup(ctx, ttl)
+			if err != nil {
+				log.Error().Err(err).Msg("error cleaning up idempotency keys")
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PgStore keeps keys in the idempotency_keys table so retries may reach any instance.
+type PgStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStore(db *pgxpool.Pool) *PgStore {
+	return &PgStore{db: db}
+}
+
+func (s *PgStore) Begin(ctx context.Context, scope string, key string, fingerprint string, ttl time.Duration, lockTimeout time.Duration) (*Record, error) {
+	args := pgx.NamedArgs{
+		"scope":       scope,
+		"key":         key,
+		"fingerprint": fingerprint,
+		"cutoff":      time.Now().Add(-ttl),
+		"lockCutoff":  time.Now().Add(-lockTimeout),
+	}
+	//a new key is inserted and an expired or abandoned one taken over, either way the row comes back
+	var claimed bool
+	err := s.db.QueryRow(ctx, `INSERT INTO idempotency_keys (scope, key, fingerprint) VALUES (@scope, @key, @fingerprint)
+		ON CONFLICT (scope, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = NULL, header = NULL, body = NULL, created_at = NOW()
+		WHERE idempotency_keys.created_at < @cutoff
+		OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at < @lockCutoff)
+		RETURNING TRUE`, args).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("unable to claim idempotency key: %w", err)
+	}
+
+	var record Record
+	var status *int
+	var header []byte
+	var body []byte
+	err = s.db.QueryRow(ctx, "SELECT fingerprint, status, header, body FROM idempotency_keys WHERE scope = @scope AND key = @key", args).
+		Scan(&record.Fingerprint, &status, &header, &body)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			//released in between, report it as in progress and let the client retry
+			return &Record{Fingerprint: fingerprint}, nil
+		}
+		return nil, fmt.Errorf("unable to select idempotency key: %w", err)
+	}
+	if status != nil {
+		record.Response = &Response{Status: *status, Header: http.Header{}, Body: body}
+		err = json.Unmarshal(header, &record.Response.Header)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode stored headers: %w", err)
+		}
+	}
+	return &record, nil
+}
+
+func (s *PgStore) Complete(ctx context.Context, scope string, key string, response Response) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return fmt.Errorf("unable to encode headers: %w", err)
+	}
+	args := pgx.NamedArgs{
+		"scope":  scope,
+		"key":    key,
+		"status": response.Status,
+		"header": header,
+		"body":   response.Body,
+	}
+	_, err = s.db.Exec(ctx, "UPDATE idempotency_keys SET status = @status, header = @header, body = @body WHERE scope = @scope AND key = @key AND status IS NULL", args)
+	if err != nil {
+		return fmt.Errorf("unable to store response: %w", err)
+	}
+	return nil
+}
+
+func (s *PgStore) Release(ctx context.Context, scope string, key string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status IS NULL", scope, key)
+	if err != nil {
+		return fmt.Errorf("unable to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *PgStore) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	args := pgx.NamedArgs{
+		"cutoff": time.Now().Add(-olderThan),
+	}
+	_, err := s.db.Exec(ctx, "DELETE FROM idempotency_keys WHERE created_at < @cutoff", args)
+	if err != nil {
+		return fmt.Errorf("unable to delete expired idempotency keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FileMailer appends every mail as a JSON line to a file instead of sending it,
+// meant for local testing where the links in the mails are read from the file.
+type FileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		To      string    `json:"to"`
+		Subject string    `json:"subject"`
+		Body    string    `json:"body"`
+	}{time.Now(), msg.To, msg.Subject, msg.Body})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// LogMailer writes every mail to the log instead of sending it. The body contains
+// secrets like reset links, never use it in production.
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Ctx(ctx).Info().
+		Str("to", msg.To).
+		Str("subject", msg.Subject).
+		Str("body", msg.Body).
+		Msg("mail not sent, log mailer in use")
+	return nil
+}
@@ -0,0 +1,17 @@
+package mailer
+
+import (
+	"context"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends plain text mails. Implementations must honour ctx, handlers usually
+// send from a Queue detached from the request.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
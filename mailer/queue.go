@@ -0,0 +1,32 @@
+package mailer
+
+// Queue runs mail jobs on a fixed number of workers, so a burst of requests cannot
+// start an unbounded number of goroutines that all wait for the mail server.
+type Queue struct {
+	jobs chan func()
+}
+
+// NewQueue starts the workers, at most size jobs wait for a free worker.
+func NewQueue(workers int, size int) *Queue {
+	q := &Queue{jobs: make(chan func(), size)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *Queue) work() {
+	for job := range q.jobs {
+		job()
+	}
+}
+
+// Enqueue returns false without running the job when the queue is full.
+func (q *Queue) Enqueue(job func()) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestQueueDropsJobsWhenFull(t *testing.T) {
+	q := NewQueue(1, 2)
+	release := make(chan struct{})
+	var done sync.WaitGroup
+
+	//the worker blocks on the first job, two more fit the queue
+	started := make(chan struct{})
+	done.Add(1)
+	if !q.Enqueue(func() { close(started); <-release; done.Done() }) {
+		t.Fatal("first job was dropped")
+	}
+	<-started
+	for i := 0; i < 2; i++ {
+		done.Add(1)
+		if !q.Enqueue(func() { done.Done() }) {
+			t.Fatalf("job %d was dropped before the queue was full", i+2)
+		}
+	}
+	if q.Enqueue(func() { t.Error("dropped job ran") }) {
+		t.Error("Enqueue() = true on a full queue, want false")
+	}
+
+	close(release)
+	done.Wait()
+	if !q.Enqueue(func() {}) {
+		t.Error("Enqueue() = false after the queue drained, want true")
+	}
+}
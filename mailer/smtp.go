@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	// upgrade the connection with STARTTLS, required before credentials are sent
+	startTLS bool
+}
+
+func NewSMTPMailer(host string, port int, username string, password string, from string, startTLS bool) *SMTPMailer {
+	return &SMTPMailer{host: host, port: port, username: username, password: password, from: from, startTLS: startTLS}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.host, strconv.Itoa(m.port)))
+	if err != nil {
+		return fmt.Errorf("unable to connect to smtp server: %w", err)
+	}
+	//net/smtp has no context support, the deadline bounds the whole conversation instead
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to start smtp session: %w", err)
+	}
+	defer client.Close()
+
+	if m.startTLS {
+		err = client.StartTLS(&tls.Config{ServerName: m.host})
+		if err != nil {
+			return fmt.Errorf("unable to start tls: %w", err)
+		}
+	}
+	if m.username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.username, m.password, m.host))
+		if err != nil {
+			return fmt.Errorf("unable to authenticate: %w", err)
+		}
+	}
+
+	err = client.Mail(m.from)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(msg.To)
+	if err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(m.format(msg))
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *SMTPMailer) format(msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + m.from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
 	"github.com/defilippomattia/gorest/apis/companies"
+	"github.com/defilippomattia/gorest/apis/departments"
 	"github.com/defilippomattia/gorest/apis/users"
+	"github.com/defilippomattia/gorest/audit"
+	"github.com/defilippomattia/gorest/auth"
 	"github.com/defilippomattia/gorest/config"
 	"github.com/defilippomattia/gorest/database"
 	"github.com/defilippomattia/gorest/employees"
 	"github.com/defilippomattia/gorest/healthz"
+	"github.com/defilippomattia/gorest/idempotency"
+	"github.com/defilippomattia/gorest/mailer"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/defilippomattia/gorest/middleware"
+	"github.com/defilippomattia/gorest/oidc"
+	"github.com/defilippomattia/gorest/ratelimit"
+	"github.com/defilippomattia/gorest/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -20,6 +39,8 @@ import (
 func main() {
 
 	zerolog.TimeFieldFormat = "2006-01-02 15:04:05.000"
+	//log.Ctx(ctx) falls back to the global logger when the context has no request logger
+	zerolog.DefaultContextLogger = &log.Logger
 	//until the log level is set from config file, set it to trace
 	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 
@@ -42,8 +63,24 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(logLevel)
 
+	auth.SetParams(auth.Params{
+		Memory:      cfg.Argon2.MemoryKiB,
+		Iterations:  cfg.Argon2.Iterations,
+		Parallelism: cfg.Argon2.Parallelism,
+		SaltLength:  cfg.Argon2.SaltLength,
+		KeyLength:   cfg.Argon2.KeyLength,
+	})
+	auth.SetConcurrency(cfg.Argon2.MaxConcurrency, time.Duration(cfg.Argon2.QueueTimeoutMs)*time.Millisecond)
+
 	dbConnURL := "postgres://" + cfg.Database.Username + ":" + cfg.Database.Password + "@" + cfg.Database.Host + ":" + cfg.Database.Port + "/" + cfg.Database.Name
-	conn, err := database.ConnectToDatabase(dbConnURL)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("error setting up tracing, exiting application...")
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	conn, err := database.ConnectToDatabase(dbConnURL, tracing.NewQueryTracer())
 	if err != nil {
 		log.Error().Msg("exiting application...")
 		os.Exit(1)
@@ -51,28 +88,265 @@ func main() {
 	defer conn.Close()
 
 	log.Info().Msg("connected to database successfully")
+	metrics.RegisterPool(conn)
+
 	router := chi.NewRouter()
+	//middlewares must be registered before any route, humachi.New already registers /docs
+	router.Use(middleware.RequestID)
+	router.Use(middleware.Tracing)
+	router.Use(middleware.AccessLog)
+	router.Use(middleware.Metrics)
+	router.Use(middleware.SecurityHeaders(middleware.SecurityHeadersOptions{
+		HSTSMaxAge:            time.Duration(cfg.Security.HSTSMaxAgeSeconds) * time.Second,
+		HSTSIncludeSubdomains: cfg.Security.HSTSIncludeSubdomains,
+		ReferrerPolicy:        cfg.Security.ReferrerPolicy,
+		DocsPath:              "/docs",
+		DocsCSP:               cfg.Security.DocsCSP,
+	}))
+	router.Use(middleware.BodyLimit(cfg.Security.MaxBodyBytes))
+
+	if cfg.CORS.Enabled {
+		cors, err := middleware.NewCORS(middleware.CORSOptions{
+			AllowedOrigins:   cfg.CORS.AllowedOrigins,
+			AllowedMethods:   cfg.CORS.AllowedMethods,
+			AllowedHeaders:   cfg.CORS.AllowedHeaders,
+			ExposedHeaders:   cfg.CORS.ExposedHeaders,
+			AllowCredentials: cfg.CORS.AllowCredentials,
+			MaxAge:           time.Duration(cfg.CORS.MaxAgeSeconds) * time.Second,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("error setting up cors, exiting application...")
+			os.Exit(1)
+		}
+		//preflight requests carry no credentials, so cors runs before authentication
+		router.Use(cors.Handler)
+		go reloadCORSOrigins(configFilePath, cors)
+	}
+
+	routeQueryTimeouts := make(map[string]time.Duration)
+	for route, timeoutMs := range cfg.Database.RouteQueryTimeoutsMs {
+		routeQueryTimeouts[route] = time.Duration(timeoutMs) * time.Millisecond
+	}
+	router.Use(middleware.QueryTimeout(router, time.Duration(cfg.Database.QueryTimeoutMs)*time.Millisecond, routeQueryTimeouts))
+
+	userRepo := users.NewPgUserRepository(conn)
+
+	var tokenAuth *users.TokenAuth
+	var accessTokenValidator middleware.AccessTokenValidator
+	if cfg.TokenAuth.Enabled {
+		tokenIssuer, err := newTokenIssuer(cfg)
+		if err != nil {
+			log.Error().Err(err).Msg("error setting up token auth, exiting application...")
+			os.Exit(1)
+		}
+		tokenAuth = &users.TokenAuth{
+			Issuer:          tokenIssuer,
+			RefreshTokens:   users.NewPgRefreshTokenRepository(conn),
+			RefreshTokenTTL: time.Duration(cfg.TokenAuth.RefreshTokenTTLSeconds) * time.Second,
+		}
+		accessTokenValidator = tokenIssuer
+	}
+	var rateLimit func(beforeAuth bool) func(http.Handler) http.Handler
+	if cfg.RateLimit.Enabled {
+		var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+		if cfg.RateLimit.Store == "postgres" {
+			rateLimitStore = ratelimit.NewPgStore(conn)
+		}
+
+		var policies []ratelimit.Policy
+		var defaultRateLimit *middleware.RateLimitPolicy
+		if cfg.RateLimit.Default != nil {
+			policy := rateLimitPolicy(*cfg.RateLimit.Default)
+			defaultRateLimit = &policy
+			policies = append(policies, policy.Policy)
+		}
+		routeRateLimits := make(map[string]middleware.RateLimitPolicy)
+		for route, policy := range cfg.RateLimit.Routes {
+			routeRateLimits[route] = rateLimitPolicy(policy)
+			policies = append(policies, routeRateLimits[route].Policy)
+		}
+		//buckets are only removed once they would be full again under every policy
+		go ratelimit.RunCleanup(context.Background(), rateLimitStore, time.Minute, ratelimit.IdleCutoff(policies...))
+		rateLimit = func(beforeAuth bool) func(http.Handler) http.Handler {
+			return middleware.RateLimit(router, rateLimitStore, defaultRateLimit, routeRateLimits, beforeAuth)
+		}
+		router.Use(rateLimit(true))
+	}
+
+	apiKeyRepo := users.NewPgAPIKeyRepository(conn)
+	router.Use(middleware.Authenticate(middleware.Authenticators{
+		Sessions:     userRepo,
+		AccessTokens: accessTokenValidator,
+		APIKeys:      apiKeyRepo,
+	}))
+	router.Use(middleware.CSRF(router, []string{
+		"POST /api/users/register",
+		"POST /api/users/login",
+		"POST /api/users/login/2fa",
+		"POST /api/users/token/refresh",
+		"POST /api/users/password-reset/request",
+		"POST /api/users/password-reset/confirm",
+		"POST /api/users/verify/resend",
+	}))
+
+	if rateLimit != nil {
+		router.Use(rateLimit(false))
+	}
+
+	idempotencyStore := idempotency.NewPgStore(conn)
+	idempotencyTTL := time.Duration(cfg.Idempotency.ExpirySeconds) * time.Second
+	idempotencyLockTimeout := time.Duration(cfg.Idempotency.LockTimeoutSeconds) * time.Second
+	go idempotency.RunCleanup(context.Background(), idempotencyStore, time.Minute, idempotencyTTL)
+	router.Use(middleware.Idempotency(router, idempotencyStore, idempotencyTTL, idempotencyLockTimeout, []string{
+		"POST /api/companies",
+		"POST /api/companies/{id}/employees",
+		"POST /api/companies/{id}/departments",
+		"POST /api/employees",
+	}))
+
 	api := humachi.New(router, huma.DefaultConfig("gorest API", "1.0.0"))
 
 	huma.Get(api, "/api/healthz", healthz.GetHealth)
+	router.Handle("/metrics", metrics.Handler())
 
-	huma.Get(api, "/api/employees", employees.GetEmployees(conn))
-	huma.Get(api, "/api/employees/{id}", employees.GetEmployeeById(conn))
-	huma.Post(api, "/api/employees", employees.CreateEmployee(conn))
+	auditRepo := audit.NewPgRepository(conn)
+	auditLog := audit.NewRecorder(auditRepo)
+
+	huma.Get(api, "/api/employees", employees.GetEmployees(conn, userRepo))
+	huma.Get(api, "/api/employees/{id}", employees.GetEmployeeById(conn, userRepo))
+	huma.Post(api, "/api/employees", employees.CreateEmployee(conn, auditLog))
+	huma.Delete(api, "/api/employees/{id}", employees.DeleteEmployee(conn, auditLog, cfg.Concurrency.RequireIfMatch))
+	huma.Post(api, "/api/employees/{id}/restore", employees.RestoreEmployee(conn, userRepo, auditLog))
+	huma.Get(api, "/api/employees/{id}/reports", employees.GetReports(conn))
+	huma.Get(api, "/api/employees/{id}/chain", employees.GetChain(conn))
+	huma.Put(api, "/api/employees/{id}/manager", employees.AssignManager(conn, auditLog, cfg.Concurrency.RequireIfMatch))
+	huma.Put(api, "/api/employees/{id}/department", employees.AssignDepartment(conn, auditLog, cfg.Concurrency.RequireIfMatch))
+	huma.Get(api, "/api/companies/{id}/employees", employees.GetCompanyEmployees(conn, userRepo))
+	huma.Post(api, "/api/companies/{id}/employees", employees.CreateCompanyEmployee(conn, auditLog))
 
 	companyRepo := companies.NewPgCompanyRepository(conn)
-	companyHandler := companies.NewCompanyHandler(companyRepo)
+	companyHandler := companies.NewCompanyHandler(companyRepo, userRepo, auditLog, cfg.Concurrency.RequireIfMatch)
 
 	router.Post("/api/companies", companyHandler.CreateCompany)
 	router.Get("/api/companies", companyHandler.GetCompanies)
 	router.Get("/api/companies/{id}", companyHandler.GetCompanyByID)
 
-	userRepo := users.NewPgUserRepository(conn)
-	userHandler := users.NewUserHandler(userRepo)
+	departmentHandler := departments.NewDepartmentHandler(departments.NewPgDepartmentRepository(conn), auditLog)
+
+	router.Get("/api/companies/{id}/departments", departmentHandler.GetDepartments)
+	router.Get("/api/companies/{id}/departments/{departmentID}", departmentHandler.GetDepartmentByID)
+
+	if cfg.SoftDelete.RetentionDays > 0 {
+		go runPurge(auditLog, time.Duration(cfg.SoftDelete.PurgeIntervalSeconds)*time.Second, time.Duration(cfg.SoftDelete.RetentionDays)*24*time.Hour, map[string]purgeFunc{
+			audit.ResourceCompany: companyRepo.Purge,
+			audit.ResourceEmployee: func(ctx context.Context, olderThan time.Duration) (int64, error) {
+				return employees.Purge(ctx, conn, olderThan)
+			},
+		})
+	}
+
+	loginProtection := users.NewLoginProtection(users.NewPgLoginAttemptRepository(conn), users.LoginProtectionPolicy{
+		MaxFailures:   cfg.LoginProtection.MaxFailures,
+		IPMaxFailures: cfg.LoginProtection.IPMaxFailures,
+		FailureWindow: time.Duration(cfg.LoginProtection.FailureWindowSeconds) * time.Second,
+		Lockout:       time.Duration(cfg.LoginProtection.LockoutSeconds) * time.Second,
+		BaseDelay:     time.Duration(cfg.LoginProtection.BaseDelayMs) * time.Millisecond,
+		MaxDelay:      time.Duration(cfg.LoginProtection.MaxDelayMs) * time.Millisecond,
+	})
+	passwordPolicy := &auth.PasswordPolicy{
+		MinLength:                cfg.PasswordPolicy.MinLength,
+		MaxLength:                cfg.PasswordPolicy.MaxLength,
+		RequireUppercase:         cfg.PasswordPolicy.RequireUppercase,
+		RequireLowercase:         cfg.PasswordPolicy.RequireLowercase,
+		RequireDigit:             cfg.PasswordPolicy.RequireDigit,
+		RequireSymbol:            cfg.PasswordPolicy.RequireSymbol,
+		RejectUsernameSimilarity: cfg.PasswordPolicy.RejectUsernameSimilarity,
+	}
+	if cfg.PasswordPolicy.CheckBreached {
+		passwordPolicy.Breached, err = auth.LoadBreachedPasswords(cfg.PasswordPolicy.BreachedPasswordsFile)
+		if err != nil {
+			log.Error().Err(err).Msg("error loading breached passwords, exiting application...")
+			os.Exit(1)
+		}
+		log.Info().Int("count", passwordPolicy.Breached.Len()).Msg("loaded breached passwords")
+	}
+	twoFactor := &users.TwoFactor{
+		Repo:         users.NewPgTwoFactorRepository(conn),
+		Issuer:       cfg.TwoFactor.Issuer,
+		ChallengeTTL: time.Duration(cfg.TwoFactor.ChallengeTTLSeconds) * time.Second,
+		MaxAttempts:  cfg.TwoFactor.ChallengeMaxAttempts,
+	}
+	mailQueue := mailer.NewQueue(cfg.Mail.Workers, cfg.Mail.QueueSize)
+	passwordReset := &users.PasswordReset{
+		Repo:     users.NewPgPasswordResetRepository(conn),
+		Mailer:   newMailer(cfg),
+		Queue:    mailQueue,
+		TokenTTL: time.Duration(cfg.PasswordReset.TokenTTLSeconds) * time.Second,
+		URL:      cfg.PasswordReset.URL,
+		//per instance, the token repository enforces the interval across instances
+		Throttle:    ratelimit.NewMemoryStore(),
+		MinInterval: time.Duration(cfg.PasswordReset.MinIntervalSeconds) * time.Second,
+	}
+	go ratelimit.RunCleanup(context.Background(), passwordReset.Throttle, time.Minute, ratelimit.IdleCutoff(passwordReset.ThrottlePolicy()))
+	emailVerification := &users.EmailVerification{
+		Repo:     users.NewPgEmailVerificationRepository(conn),
+		Mailer:   passwordReset.Mailer,
+		Queue:    mailQueue,
+		TokenTTL: time.Duration(cfg.EmailVerification.TokenTTLSeconds) * time.Second,
+		URL:      cfg.EmailVerification.URL,
+		Required: cfg.EmailVerification.Required,
+		//per instance, the token repository enforces the interval across instances
+		Throttle:    ratelimit.NewMemoryStore(),
+		MinInterval: time.Duration(cfg.EmailVerification.MinIntervalSeconds) * time.Second,
+	}
+	go ratelimit.RunCleanup(context.Background(), emailVerification.Throttle, time.Minute, ratelimit.IdleCutoff(emailVerification.ThrottlePolicy()))
+	userHandler := users.NewUserHandler(userRepo, loginProtection, passwordPolicy, tokenAuth, twoFactor, passwordReset, emailVerification, auditLog)
 
 	router.Post("/api/users/register", userHandler.RegisterUser)
 	router.Post("/api/users/login", userHandler.LoginUser)
-	router.Get("/api/users/me", userHandler.GetMe)
+	router.Post("/api/users/login/2fa", userHandler.LoginTwoFactor)
+	router.Post("/api/users/token/refresh", userHandler.RefreshToken)
+	router.Post("/api/users/password-reset/request", userHandler.RequestPasswordReset)
+	router.Post("/api/users/password-reset/confirm", userHandler.ConfirmPasswordReset)
+	router.Get("/api/users/verify", userHandler.VerifyEmail)
+	router.Post("/api/users/verify/resend", userHandler.ResendVerification)
+
+	oidcProviders := make(map[string]users.OIDCProvider)
+	for name, provider := range cfg.OIDC.Providers {
+		redirectURL := strings.TrimSuffix(cfg.OIDC.RedirectBaseURL, "/") + "/api/auth/oidc/" + name + "/callback"
+		oidcProviders[name] = users.OIDCProvider{
+			Client:          oidc.NewProvider(provider.IssuerURL, provider.ClientID, provider.ClientSecret, redirectURL, provider.Scopes),
+			AutoCreateUsers: provider.AutoCreateUsers,
+		}
+	}
+	oidcHandler := users.NewOIDCHandler(users.NewPgOIDCRepository(conn), oidcProviders, userHandler)
+	router.Get("/api/auth/oidc/{provider}/login", oidcHandler.Login)
+	router.Get("/api/auth/oidc/{provider}/callback", oidcHandler.Callback)
+
+	router.Group(func(r chi.Router) {
+		r.Use(middleware.RequireAuth)
+		r.Get("/api/users/me", userHandler.GetMe)
+		r.Delete("/api/companies/{id}", companyHandler.DeleteCompany)
+		r.Post("/api/companies/{id}/departments", departmentHandler.CreateDepartment)
+		r.Post("/api/users/logout", userHandler.Logout)
+		r.Put("/api/users/me/password", userHandler.ChangePassword)
+		r.Post("/api/users/me/2fa", userHandler.EnrollTwoFactor)
+		r.Post("/api/users/me/2fa/confirm", userHandler.ConfirmTwoFactor)
+		r.Delete("/api/users/me/2fa", userHandler.DisableTwoFactor)
+
+		apiKeyHandler := users.NewAPIKeyHandler(apiKeyRepo)
+		r.Post("/api/users/me/api-keys", apiKeyHandler.CreateAPIKey)
+		r.Get("/api/users/me/api-keys", apiKeyHandler.GetAPIKeys)
+		r.Delete("/api/users/me/api-keys/{id}", apiKeyHandler.RevokeAPIKey)
+	})
+
+	router.Group(func(r chi.Router) {
+		r.Use(middleware.RequireAuth)
+		r.Use(middleware.RequireAdmin(userRepo))
+		r.Post("/api/admin/users/unlock", userHandler.UnlockLogin)
+		r.Get("/api/admin/audit", audit.NewHandler(auditRepo).GetEvents)
+		r.Post("/api/companies/{id}/restore", companyHandler.RestoreCompany)
+	})
 
 	apiEndpoint := "127.0.0.1:" + cfg.APIPort
 
@@ -81,3 +355,103 @@ func main() {
 	http.ListenAndServe(apiEndpoint, router)
 
 }
+
+func rateLimitPolicy(policy config.RateLimitPolicy) middleware.RateLimitPolicy {
+	return middleware.RateLimitPolicy{
+		Policy: ratelimit.Policy{
+			Requests: policy.Requests,
+			Period:   time.Duration(policy.PeriodSeconds) * time.Second,
+			Burst:    policy.Burst,
+		},
+		KeyBy: policy.KeyBy,
+	}
+}
+
+func newTokenIssuer(cfg *config.Config) (*auth.TokenIssuer, error) {
+	var keys []auth.SigningKey
+	for _, configKey := range cfg.TokenAuth.Keys {
+		key := auth.SigningKey{ID: configKey.ID}
+		//the values are already validated as base64
+		if configKey.Secret != "" {
+			key.Secret, _ = base64.StdEncoding.DecodeString(configKey.Secret)
+		}
+		if configKey.PrivateKey != "" {
+			seed, _ := base64.StdEncoding.DecodeString(configKey.PrivateKey)
+			if len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwt key %q: private_key must be a %d byte ed25519 seed", configKey.ID, ed25519.SeedSize)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(seed)
+		}
+		if configKey.PublicKey != "" {
+			publicKey, _ := base64.StdEncoding.DecodeString(configKey.PublicKey)
+			if len(publicKey) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("jwt key %q: public_key must be %d bytes", configKey.ID, ed25519.PublicKeySize)
+			}
+			key.PublicKey = publicKey
+		}
+		keys = append(keys, key)
+	}
+
+	accessTokenTTL := time.Duration(cfg.TokenAuth.AccessTokenTTLSeconds) * time.Second
+	return auth.NewTokenIssuer(cfg.TokenAuth.Algorithm, cfg.TokenAuth.Issuer, accessTokenTTL, cfg.TokenAuth.ActiveKeyID, keys)
+}
+
+func newMailer(cfg *config.Config) mailer.Mailer {
+	switch cfg.Mail.Sender {
+	case "file":
+		return mailer.NewFileMailer(cfg.Mail.FilePath)
+	case "log":
+		return mailer.NewLogMailer()
+	default:
+		smtpCfg := cfg.Mail.SMTP
+		return mailer.NewSMTPMailer(smtpCfg.Host, smtpCfg.Port, smtpCfg.Username, smtpCfg.Password, cfg.Mail.From, smtpCfg.StartTLS)
+	}
+}
+
+// reloadCORSOrigins rereads the config file on SIGHUP and applies its allowed origins,
+// other changes need a restart. An invalid file keeps the current origins.
+func reloadCORSOrigins(configFilePath string, cors *middleware.CORS) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		cfg, err := config.ReadConfig(configFilePath)
+		if err != nil {
+			log.Error().Err(err).Msg("error reloading config, keeping cors origins")
+			continue
+		}
+		err = cors.SetAllowedOrigins(cfg.CORS.AllowedOrigins)
+		if err != nil {
+			log.Error().Err(err).Msg("error reloading cors origins, keeping cors origins")
+			continue
+		}
+		log.Info().Strs("allowed_origins", cfg.CORS.AllowedOrigins).Msg("cors origins reloaded")
+	}
+}
+
+// purgeFunc removes soft deleted rows deleted longer than olderThan ago and returns their count.
+type purgeFunc func(ctx context.Context, olderThan time.Duration) (int64, error)
+
+// runPurge removes soft deleted resources once their retention passed, every purge that
+// removed rows is recorded in the audit log.
+func runPurge(auditLog *audit.Recorder, interval time.Duration, retention time.Duration, purges map[string]purgeFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for resourceType, purge := range purges {
+			purged, err := purge(context.Background(), retention)
+			if err != nil {
+				log.Error().Err(err).Str("resource_type", resourceType).Msg("error purging soft deleted rows")
+				continue
+			}
+			if purged == 0 {
+				continue
+			}
+			log.Info().Str("resource_type", resourceType).Int64("purged", purged).Msg("purged soft deleted rows")
+			auditLog.Record(context.Background(), audit.Event{
+				Action:       audit.ActionPurge,
+				ResourceType: resourceType,
+				Metadata:     map[string]string{"count": strconv.FormatInt(purged, 10), "retention": retention.String()},
+			})
+		}
+	}
+}
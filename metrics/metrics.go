@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gorest"
+
+// Registry holds every gorest metric, a dedicated registry keeps the output
+// independent from whatever other libraries register on the default one.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled HTTP requests.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of handled HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	LoginsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_logins_total",
+		Help:      "Number of successful logins.",
+	})
+
+	FailedLoginsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failed_logins_total",
+		Help:      "Number of rejected logins.",
+	})
+
+	RegistrationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_registrations_total",
+		Help:      "Number of registered users.",
+	})
+
+	SessionValidationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_session_validations_total",
+		Help:      "Number of session token validations by result (valid, invalid).",
+	}, []string{"result"})
+
+	HashingQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "auth_hashing_queue_wait_seconds",
+		Help:      "Time password hashing operations waited for a free slot.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+
+	HashingRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_hashing_rejected_total",
+		Help:      "Number of password hashing operations rejected because all slots stayed busy.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestsTotal,
+		HTTPRequestDuration,
+		LoginsTotal,
+		FailedLoginsTotal,
+		RegistrationsTotal,
+		SessionValidationsTotal,
+		HashingQueueWait,
+		HashingRejectedTotal,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
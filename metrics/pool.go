@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reads pgxpool stats on every scrape instead of keeping gauges in sync.
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquiredConns        *prometheus.Desc
+	idleConns            *prometheus.Desc
+	totalConns           *prometheus.Desc
+	maxConns             *prometheus.Desc
+	acquireCount         *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+	acquireWaitDuration  *prometheus.Desc
+}
+
+func newPoolDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+}
+
+// RegisterPool exposes the stats of the database connection pool.
+func RegisterPool(pool *pgxpool.Pool) {
+	Registry.MustRegister(&poolCollector{
+		pool:                 pool,
+		acquiredConns:        newPoolDesc("acquired_conns", "Number of connections currently in use."),
+		idleConns:            newPoolDesc("idle_conns", "Number of idle connections."),
+		totalConns:           newPoolDesc("total_conns", "Number of open connections."),
+		maxConns:             newPoolDesc("max_conns", "Maximum size of the pool."),
+		acquireCount:         newPoolDesc("acquire_total", "Number of successful connection acquires."),
+		emptyAcquireCount:    newPoolDesc("empty_acquire_total", "Number of acquires that had to wait for a connection."),
+		canceledAcquireCount: newPoolDesc("canceled_acquire_total", "Number of acquires cancelled by their context."),
+		acquireWaitDuration:  newPoolDesc("acquire_duration_seconds_total", "Total time spent waiting for a connection."),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.emptyAcquireCount
+	ch <- c.canceledAcquireCount
+	ch <- c.acquireWaitDuration
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireWaitDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
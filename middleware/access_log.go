@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo is filled while the request is handled and read by AccessLog
+// once the handler returns.
+type requestInfo struct {
+	userID     int
+	authMethod string
+	clientIP   string
+}
+
+// SetAuthenticated records the authenticated user of the request and how it was
+// authenticated (one of the AuthMethod constants) so it ends up in the access log.
+func SetAuthenticated(ctx context.Context, userID int, authMethod string) {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if ok {
+		info.userID = userID
+		info.authMethod = authMethod
+	}
+}
+
+// GetUserID returns the authenticated user of the request, -1 if there is none.
+func GetUserID(ctx context.Context) int {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return -1
+	}
+	return info.userID
+}
+
+// GetAuthMethod returns how the request was authenticated, empty if it was not.
+func GetAuthMethod(ctx context.Context) string {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return ""
+	}
+	return info.authMethod
+}
+
+// GetClientIP returns the ip address of the client, for code that only has the context.
+func GetClientIP(ctx context.Context) string {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return ""
+	}
+	return info.clientIP
+}
+
+// AccessLog emits one structured log line per request. It must be registered after RequestID
+// so the line carries the request id.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{userID: -1, clientIP: ClientIP(r)}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			// handler did not write anything, net/http answers with 200
+			status = http.StatusOK
+		}
+
+		routePattern := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			routePattern = rctx.RoutePattern()
+		}
+
+		event := log.Ctx(ctx).Info()
+		if status >= http.StatusInternalServerError {
+			event = log.Ctx(ctx).Error()
+		}
+		event.
+			Str("event", "http.access").
+			Str("method", r.Method).
+			Str("route", routePattern).
+			Str("path", r.URL.Path).
+			Int("status", status).
+			Int("bytes", ww.BytesWritten()).
+			Dur("latency", time.Since(start)).
+			Int("user_id", info.userID).
+			Str("auth_method", info.authMethod).
+			Str("remote_addr", r.RemoteAddr).
+			Msg("request handled")
+	})
+}
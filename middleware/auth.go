@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AuthMethodSession = "session"
+	AuthMethodBearer  = "bearer"
+	AuthMethodAPIKey  = "api_key"
+)
+
+// api keys carry scopes, read allows safe methods and write allows the others
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+type SessionValidator interface {
+	ValidateSessionToken(ctx context.Context, sessionToken string) (int, error)
+}
+
+type AccessTokenValidator interface {
+	ValidateAccessToken(accessToken string) (int, error)
+}
+
+type APIKeyValidator interface {
+	ValidateAPIKey(ctx context.Context, apiKey string) (int, []string, error)
+}
+
+// Authenticators validate the credentials Authenticate accepts.
+type Authenticators struct {
+	Sessions SessionValidator
+	// nil when the token auth mode is disabled
+	AccessTokens AccessTokenValidator
+	APIKeys      APIKeyValidator
+}
+
+type AdminChecker interface {
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+}
+
+type errorResponse struct {
+	ResponseType string `json:"response_type"`
+	Message      string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		ResponseType: "error",
+		Message:      message,
+	})
+}
+
+// Authenticate identifies the user from an X-API-Key header, an "Authorization: Bearer" access
+// token or the session_token cookie, in that order. Requests without credentials are passed on
+// anonymously, routes that need a user are wrapped with RequireAuth. Invalid api keys and bearer
+// tokens are rejected right away, as are api keys without the scope the request method needs.
+// The user id is available to handlers through GetUserID.
+func Authenticate(authenticators Authenticators) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+				userID, scopes, err := authenticators.APIKeys.ValidateAPIKey(r.Context(), apiKey)
+				if err != nil {
+					log.Ctx(r.Context()).Error().Err(err).Msg("invalid api key")
+					writeError(w, apis.ErrorStatus(r.Context(), err, http.StatusUnauthorized), "unauthorized - api key is invalid, expired or revoked")
+					return
+				}
+				if !slices.Contains(scopes, requiredScope(r.Method)) {
+					log.Ctx(r.Context()).Warn().Int("user_id", userID).Strs("scopes", scopes).Msg("api key lacks scope")
+					writeError(w, http.StatusForbidden, "forbidden - api key lacks the "+requiredScope(r.Method)+" scope")
+					return
+				}
+				SetAuthenticated(r.Context(), userID, AuthMethodAPIKey)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if bearerToken, ok := bearerToken(r); ok && authenticators.AccessTokens != nil {
+				userID, err := authenticators.AccessTokens.ValidateAccessToken(bearerToken)
+				if err != nil {
+					log.Ctx(r.Context()).Error().Err(err).Msg("invalid access token")
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					writeError(w, http.StatusUnauthorized, "unauthorized - access token is invalid or expired")
+					return
+				}
+				SetAuthenticated(r.Context(), userID, AuthMethodBearer)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cookie, err := r.Cookie("session_token")
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			userID, err := authenticators.Sessions.ValidateSessionToken(r.Context(), cookie.Value)
+			if err != nil {
+				metrics.SessionValidationsTotal.WithLabelValues("invalid").Inc()
+				log.Ctx(r.Context()).Error().Err(err).Msg("invalid session token")
+				status := apis.ErrorStatus(r.Context(), err, http.StatusUnauthorized)
+				if status != http.StatusUnauthorized {
+					writeError(w, status, "could not validate session token")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			metrics.SessionValidationsTotal.WithLabelValues("valid").Inc()
+			SetAuthenticated(r.Context(), userID, AuthMethodSession)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func requiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// RequireAuth rejects requests that Authenticate could not identify.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetUserID(r.Context()) == -1 {
+			log.Ctx(r.Context()).Error().Msg("no valid credentials provided")
+			writeError(w, http.StatusUnauthorized, "unauthorized - session token is missing or invalid")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin rejects requests of users that are not admins, it must run after RequireAuth.
+func RequireAdmin(checker AdminChecker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := GetUserID(r.Context())
+			isAdmin, err := checker.IsAdmin(r.Context(), userID)
+			if err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Int("user_id", userID).Msg("error checking admin permission")
+				writeError(w, apis.ErrorStatus(r.Context(), err, http.StatusInternalServerError), "could not check permissions")
+				return
+			}
+			if !isAdmin {
+				log.Ctx(r.Context()).Warn().Int("user_id", userID).Msg("admin endpoint called by non admin user")
+				writeError(w, http.StatusForbidden, "forbidden - admin permission required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IsAdmin reports whether the authenticated user of the request is an admin, anonymous
+// requests are not. It is for handlers that offer admins more than other users.
+func IsAdmin(ctx context.Context, checker AdminChecker) (bool, error) {
+	userID := GetUserID(ctx)
+	if userID == -1 {
+		return false, nil
+	}
+	return checker.IsAdmin(ctx, userID)
+}
+
+// ClientIP returns the ip address of the connecting client without the port.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// BodyLimit answers 413 when the declared Content-Length exceeds maxBytes and caps reading
+// bodies without one, handlers map the resulting read error with apis.DecodeErrorStatus.
+func BodyLimit(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeError(w, http.StatusRequestEntityTooLarge, "request body too large - limit is "+strconv.FormatInt(maxBytes, 10)+" bytes")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
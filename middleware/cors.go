@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type CORSOptions struct {
+	// exact origins like https://app.example.com, wildcard subdomain patterns like
+	// https://*.example.com or * for any origin
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS answers preflight requests and adds the CORS headers to responses for allowed
+// origins. It runs before routing, so chi and huma routes are covered alike. The allowed
+// origins can be replaced while serving with SetAllowedOrigins.
+type CORS struct {
+	options CORSOptions
+	origins atomic.Pointer[[]originPattern]
+}
+
+type originPattern struct {
+	any    bool
+	scheme string
+	// host with port, for wildcard patterns the part after "*."
+	host     string
+	wildcard bool
+}
+
+func NewCORS(options CORSOptions) (*CORS, error) {
+	c := &CORS{options: options}
+	err := c.SetAllowedOrigins(options.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetAllowedOrigins replaces the allowed origins, requests already being handled keep the old ones.
+func (c *CORS) SetAllowedOrigins(origins []string) error {
+	patterns := make([]originPattern, 0, len(origins))
+	for _, origin := range origins {
+		pattern, err := parseOriginPattern(origin)
+		if err != nil {
+			return err
+		}
+		//browsers refuse credentials with "*" and reflecting any origin with credentials hands every site the session
+		if pattern.any && c.options.AllowCredentials {
+			return errors.New("cors: origin * can not be combined with allow_credentials")
+		}
+		patterns = append(patterns, pattern)
+	}
+	c.origins.Store(&patterns)
+	return nil
+}
+
+func parseOriginPattern(origin string) (originPattern, error) {
+	if origin == "*" {
+		return originPattern{any: true}, nil
+	}
+	scheme, host, found := strings.Cut(strings.ToLower(origin), "://")
+	if !found || host == "" || strings.ContainsAny(host, "/?#") {
+		return originPattern{}, errors.New("cors: invalid origin " + origin)
+	}
+	if wildcardHost, ok := strings.CutPrefix(host, "*."); ok {
+		return originPattern{scheme: scheme, host: wildcardHost, wildcard: true}, nil
+	}
+	if strings.Contains(host, "*") {
+		return originPattern{}, errors.New("cors: only a leading *. is supported in origin " + origin)
+	}
+	return originPattern{scheme: scheme, host: host}, nil
+}
+
+func (c *CORS) allowedOrigin(origin string) (string, bool) {
+	originURL, err := url.Parse(strings.ToLower(origin))
+	if err != nil || originURL.Host == "" {
+		return "", false
+	}
+
+	for _, pattern := range *c.origins.Load() {
+		switch {
+		case pattern.any:
+			return "*", true
+		case pattern.scheme != originURL.Scheme:
+			continue
+		case pattern.wildcard && strings.HasSuffix(originURL.Host, "."+pattern.host):
+			return origin, true
+		case !pattern.wildcard && pattern.host == originURL.Host:
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowOrigin, allowed := c.allowedOrigin(origin)
+		if origin == "" || !allowed {
+			if preflight {
+				//no CORS headers make the browser fail the actual request
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		if c.options.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(c.options.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.options.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if !slices.Contains(c.options.AllowedMethods, requestMethod) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			header = strings.TrimSpace(header)
+			if header != "" && !slices.ContainsFunc(c.options.AllowedHeaders, func(allowed string) bool {
+				return strings.EqualFold(allowed, header)
+			}) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.options.AllowedMethods, ", "))
+		if len(c.options.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.options.AllowedHeaders, ", "))
+		}
+		if c.options.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.options.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
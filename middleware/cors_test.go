@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestCORS(t *testing.T, origins ...string) http.Handler {
+	t.Helper()
+	cors, err := NewCORS(CORSOptions{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewCORS() error = %v", err)
+	}
+	return cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+}
+
+func TestCORSOriginMatching(t *testing.T) {
+	handler := newTestCORS(t, "https://app.example.com", "https://*.example.org", "http://localhost:3000")
+
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{origin: "https://app.example.com", want: "https://app.example.com"},
+		{origin: "HTTPS://App.Example.com", want: "HTTPS://App.Example.com"},
+		{origin: "http://app.example.com"},
+		{origin: "https://app.example.com:8443"},
+		{origin: "https://evil-app.example.com"},
+		{origin: "https://app.example.com.evil.com"},
+		{origin: "https://a.example.org", want: "https://a.example.org"},
+		{origin: "https://a.b.example.org", want: "https://a.b.example.org"},
+		{origin: "https://example.org"},
+		{origin: "https://evilexample.org"},
+		{origin: "http://localhost:3000", want: "http://localhost:3000"},
+		{origin: "http://localhost:3001"},
+		{origin: "null"},
+		{origin: ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/employees", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusTeapot {
+			t.Errorf("origin %q: status = %d, want the handler to run", test.origin, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != test.want {
+			t.Errorf("origin %q: Access-Control-Allow-Origin = %q, want %q", test.origin, got, test.want)
+		}
+		wantCredentials := ""
+		if test.want != "" {
+			wantCredentials = "true"
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != wantCredentials {
+			t.Errorf("origin %q: Access-Control-Allow-Credentials = %q, want %q", test.origin, got, wantCredentials)
+		}
+		if got := rec.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("origin %q: Vary = %q, want Origin", test.origin, got)
+		}
+	}
+}
+
+func TestCORSRefusesWildcardWithCredentials(t *testing.T) {
+	_, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	if err == nil {
+		t.Error("NewCORS() accepted origin * with credentials")
+	}
+
+	cors, err := NewCORS(CORSOptions{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true})
+	if err != nil {
+		t.Fatalf("NewCORS() error = %v", err)
+	}
+	if err := cors.SetAllowedOrigins([]string{"https://app.example.com", "*"}); err == nil {
+		t.Error("SetAllowedOrigins() accepted origin * with credentials")
+	}
+	//the refused reload keeps the current origins
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin after refused reload = %q, want the current origin", got)
+	}
+
+	anyOrigin, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}})
+	if err != nil {
+		t.Fatalf("NewCORS() with * without credentials error = %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	rec = httptest.NewRecorder()
+	anyOrigin.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
+
+func TestCORSInvalidOrigins(t *testing.T) {
+	for _, origin := range []string{"app.example.com", "https://", "https://app.example.com/path", "https://app.*.example.com"} {
+		if _, err := NewCORS(CORSOptions{AllowedOrigins: []string{origin}}); err == nil {
+			t.Errorf("NewCORS() accepted invalid origin %q", origin)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	handler := newTestCORS(t, "https://app.example.com")
+
+	tests := []struct {
+		name            string
+		origin          string
+		method          string
+		headers         string
+		wantAllowed     bool
+		wantAllowOrigin string
+	}{
+		{name: "allowed", origin: "https://app.example.com", method: "POST", headers: "content-type, x-csrf-token", wantAllowed: true, wantAllowOrigin: "https://app.example.com"},
+		{name: "no request headers", origin: "https://app.example.com", method: "GET", wantAllowed: true, wantAllowOrigin: "https://app.example.com"},
+		{name: "method not allowed", origin: "https://app.example.com", method: "DELETE", wantAllowOrigin: "https://app.example.com"},
+		{name: "header not allowed", origin: "https://app.example.com", method: "POST", headers: "Content-Type, X-Custom", wantAllowOrigin: "https://app.example.com"},
+		{name: "origin not allowed", origin: "https://evil.example.com", method: "POST"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/api/employees", nil)
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", test.method)
+			if test.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			//preflights are answered by the middleware, the handler never runs
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != test.wantAllowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, test.wantAllowOrigin)
+			}
+			wantMethods, wantHeaders, wantMaxAge := "", "", ""
+			if test.wantAllowed {
+				wantMethods, wantHeaders, wantMaxAge = "GET, POST", "Content-Type, X-CSRF-Token", "600"
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, wantMethods)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Headers"); got != wantHeaders {
+				t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, wantHeaders)
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != wantMaxAge {
+				t.Errorf("Access-Control-Max-Age = %q, want %q", got, wantMaxAge)
+			}
+			if got := rec.Header().Values("Vary"); len(got) != 3 {
+				t.Errorf("Vary = %q, want Origin, Access-Control-Request-Method and Access-Control-Request-Headers", got)
+			}
+		})
+	}
+
+	//OPTIONS without Access-Control-Request-Method is a plain request
+	req := httptest.NewRequest(http.MethodOptions, "/api/employees", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("plain OPTIONS status = %d, want the handler to run", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-ID" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want X-Request-ID", got)
+	}
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/defilippomattia/gorest/apis"
+	"github.com/defilippomattia/gorest/idempotency"
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// set on responses replayed from an earlier request with the same key
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+const maxIdempotencyKeyLength = 255
+
+// Idempotency makes retries of the listed "METHOD /route/pattern" endpoints safe. The first
+// request with an Idempotency-Key header runs and its response is stored for ttl, retries
+// with the same key get that response again without running the handler. Reusing a key for
+// a different request is answered with 422, a retry while the first request still runs
+// with 409 until lockTimeout, after that the first request is taken for dead and the retry
+// runs. Server errors are not stored, the retry runs the request again. Requests without
+// the header are passed on unchanged.
+// It must run after Authenticate, keys are scoped by user and by client ip for anonymous requests.
+func Idempotency(routes chi.Routes, store idempotency.Store, ttl time.Duration, lockTimeout time.Duration, idempotent []string) func(http.Handler) http.Handler {
+	idempotentRoutes := make(map[string]bool)
+	for _, route := range idempotent {
+		idempotentRoutes[route] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rctx := chi.NewRouteContext()
+			if !routes.Match(rctx, r.Method, r.URL.Path) || !idempotentRoutes[r.Method+" "+rctx.RoutePattern()] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				writeError(w, http.StatusBadRequest, IdempotencyKeyHeader+" must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" characters")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+					return
+				}
+				writeError(w, http.StatusBadRequest, "could not read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			scope := idempotencyScope(r)
+			fingerprint := requestFingerprint(r, body)
+			record, err := store.Begin(r.Context(), scope, key, fingerprint, ttl, lockTimeout)
+			if err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Msg("error checking idempotency key")
+				writeError(w, http.StatusInternalServerError, "could not check "+IdempotencyKeyHeader)
+				return
+			}
+			if record != nil {
+				replayIdempotent(w, r, record, fingerprint)
+				return
+			}
+
+			//headers set so far come from the middleware in front, which sets them again on a replay
+			before := w.Header().Clone()
+			var responseBody bytes.Buffer
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&responseBody)
+
+			//the response is sent, storing it must not depend on the client still being there
+			ctx := context.WithoutCancel(r.Context())
+			defer func() {
+				if p := recover(); p != nil {
+					releaseIdempotencyKey(ctx, store, scope, key)
+					panic(p)
+				}
+			}()
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			//neither server errors nor requests the client gave up on tell how a retry would end
+			if status >= http.StatusInternalServerError || status == apis.StatusClientClosedRequest {
+				releaseIdempotencyKey(ctx, store, scope, key)
+				return
+			}
+			err = store.Complete(ctx, scope, key, idempotency.Response{
+				Status: status,
+				Header: handlerHeader(before, ww.Header()),
+				Body:   responseBody.Bytes(),
+			})
+			if err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("error storing idempotent response")
+			}
+		})
+	}
+}
+
+func releaseIdempotencyKey(ctx context.Context, store idempotency.Store, scope string, key string) {
+	err := store.Release(ctx, scope, key)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("error releasing idempotency key")
+	}
+}
+
+func replayIdempotent(w http.ResponseWriter, r *http.Request, record *idempotency.Record, fingerprint string) {
+	if record.Fingerprint != fingerprint {
+		log.Ctx(r.Context()).Warn().
+			Str("event", "http.idempotency_key_reused").
+			Msg("idempotency key reused for a different request")
+		writeError(w, http.StatusUnprocessableEntity, IdempotencyKeyHeader+" was already used for a different request")
+		return
+	}
+	if record.Response == nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, "a request with this "+IdempotencyKeyHeader+" is still in progress")
+		return
+	}
+
+	for name, values := range record.Response.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(record.Response.Status)
+	w.Write(record.Response.Body)
+}
+
+// idempotencyScope keeps clients from replaying each other's responses.
+func idempotencyScope(r *http.Request) string {
+	if userID := GetUserID(r.Context()); userID != -1 {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return "ip:" + ClientIP(r)
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// handlerHeader returns the headers the handler added or changed.
+func handlerHeader(before http.Header, after http.Header) http.Header {
+	header := http.Header{}
+	for name, values := range after {
+		if !slices.Equal(before[name], values) {
+			header[name] = values
+		}
+	}
+	return header
+}
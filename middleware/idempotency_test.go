@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/defilippomattia/gorest/idempotency"
+	"github.com/go-chi/chi/v5"
+)
+
+// memoryIdempotencyStore keeps keys in a map, claimedAt stands in for created_at of PgStore.
+type memoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]*memoryIdempotencyKey
+}
+
+type memoryIdempotencyKey struct {
+	record    idempotency.Record
+	claimedAt time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{keys: make(map[string]*memoryIdempotencyKey)}
+}
+
+func (s *memoryIdempotencyStore) Begin(ctx context.Context, scope string, key string, fingerprint string, ttl time.Duration, lockTimeout time.Duration) (*idempotency.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[scope+"\n"+key]
+	if ok && time.Since(existing.claimedAt) < ttl && (existing.record.Response != nil || time.Since(existing.claimedAt) < lockTimeout) {
+		record := existing.record
+		return &record, nil
+	}
+	s.keys[scope+"\n"+key] = &memoryIdempotencyKey{record: idempotency.Record{Fingerprint: fingerprint}, claimedAt: time.Now()}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, scope string, key string, response idempotency.Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[scope+"\n"+key]
+	if ok && existing.record.Response == nil {
+		existing.record.Response = &response
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, scope string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[scope+"\n"+key]
+	if ok && existing.record.Response == nil {
+		delete(s.keys, scope+"\n"+key)
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, existing := range s.keys {
+		if time.Since(existing.claimedAt) >= olderThan {
+			delete(s.keys, k)
+		}
+	}
+	return nil
+}
+
+// newIdempotentRouter serves POST /api/things with handler behind the Idempotency middleware.
+func newIdempotentRouter(store idempotency.Store, lockTimeout time.Duration, handler http.HandlerFunc) *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(Idempotency(router, store, time.Hour, lockTimeout, []string{"POST /api/things"}))
+	router.Post("/api/things", handler)
+	router.Post("/api/other-things", handler)
+	return router
+}
+
+func postThing(router http.Handler, key string, body string) *httptest.ResponseRecorder {
+	return postTo(router, "/api/things", key, body)
+}
+
+func postTo(router http.Handler, path string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// createThing answers 201 with an id counting the times it ran.
+func createThing(calls *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strconv.Itoa(int(calls.Add(1)))
+		w.Header().Set("Location", "/api/things/"+id)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":` + id + `}`))
+	}
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	var calls atomic.Int32
+	router := newIdempotentRouter(newMemoryIdempotencyStore(), time.Minute, createThing(&calls))
+
+	first := postThing(router, "key-1", `{"name":"a"}`)
+	retry := postThing(router, "key-1", `{"name":"a"}`)
+
+	if calls.Load() != 1 {
+		t.Errorf("handler ran %d times, want 1", calls.Load())
+	}
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry = %d %q, want %d %q", retry.Code, retry.Body.String(), http.StatusCreated, first.Body.String())
+	}
+	if got := retry.Header().Get("Location"); got != "/api/things/1" {
+		t.Errorf("replayed Location = %q, want /api/things/1", got)
+	}
+	if first.Header().Get(idempotentReplayedHeader) != "" || retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("%s header = %q on the first response and %q on the retry, want it only on the retry",
+			idempotentReplayedHeader, first.Header().Get(idempotentReplayedHeader), retry.Header().Get(idempotentReplayedHeader))
+	}
+
+	//other keys, requests without a key and routes that are not listed always run
+	postThing(router, "key-2", `{"name":"a"}`)
+	postThing(router, "", `{"name":"a"}`)
+	postThing(router, "", `{"name":"a"}`)
+	postTo(router, "/api/other-things", "key-1", `{"name":"a"}`)
+	if calls.Load() != 5 {
+		t.Errorf("handler ran %d times, want 5", calls.Load())
+	}
+}
+
+func TestIdempotencyRejectsKeyReuse(t *testing.T) {
+	var calls atomic.Int32
+	router := newIdempotentRouter(newMemoryIdempotencyStore(), time.Minute, createThing(&calls))
+
+	postThing(router, "key-1", `{"name":"a"}`)
+	reused := postThing(router, "key-1", `{"name":"b"}`)
+
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing a key for another body = %d, want %d", reused.Code, http.StatusUnprocessableEntity)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("handler ran %d times, want 1", calls.Load())
+	}
+}
+
+func TestIdempotencyConflictWhileInFlight(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		lockTimeout time.Duration
+		// how long the retry comes after the first request started
+		wait       time.Duration
+		wantStatus int
+	}{
+		{name: "locked", lockTimeout: time.Minute, wantStatus: http.StatusConflict},
+		{name: "lock timed out", lockTimeout: 10 * time.Millisecond, wait: 50 * time.Millisecond, wantStatus: http.StatusCreated},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls atomic.Int32
+			var blocked atomic.Bool
+			create := createThing(&calls)
+			started := make(chan struct{})
+			unblock := make(chan struct{})
+			router := newIdempotentRouter(newMemoryIdempotencyStore(), test.lockTimeout, func(w http.ResponseWriter, r *http.Request) {
+				//only the first request hangs
+				if !blocked.Swap(true) {
+					close(started)
+					<-unblock
+				}
+				create(w, r)
+			})
+
+			done := make(chan struct{})
+			go func() {
+				postThing(router, "key-1", `{"name":"a"}`)
+				close(done)
+			}()
+			<-started
+			time.Sleep(test.wait)
+			retry := postThing(router, "key-1", `{"name":"a"}`)
+			close(unblock)
+			<-done
+
+			if retry.Code != test.wantStatus {
+				t.Errorf("retry while the first request runs = %d, want %d", retry.Code, test.wantStatus)
+			}
+			if retry.Code == http.StatusConflict && retry.Header().Get("Retry-After") == "" {
+				t.Error("409 without Retry-After")
+			}
+		})
+	}
+}
+
+func TestIdempotencyReleasesKeyOnServerError(t *testing.T) {
+	var calls atomic.Int32
+	var failed atomic.Bool
+	create := createThing(&calls)
+	router := newIdempotentRouter(newMemoryIdempotencyStore(), time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		if !failed.Swap(true) {
+			http.Error(w, "database is down", http.StatusInternalServerError)
+			return
+		}
+		create(w, r)
+	})
+
+	first := postThing(router, "key-1", `{"name":"a"}`)
+	retry := postThing(router, "key-1", `{"name":"a"}`)
+
+	if first.Code != http.StatusInternalServerError {
+		t.Fatalf("first request = %d, want %d", first.Code, http.StatusInternalServerError)
+	}
+	if retry.Code != http.StatusCreated || calls.Load() != 1 {
+		t.Errorf("retry after a server error = %d with %d handler runs, want %d with 1", retry.Code, calls.Load(), http.StatusCreated)
+	}
+}
+
+func TestIdempotencyReleasesKeyOnPanic(t *testing.T) {
+	var calls atomic.Int32
+	create := createThing(&calls)
+	var panicked atomic.Bool
+	router := newIdempotentRouter(newMemoryIdempotencyStore(), time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		if !panicked.Swap(true) {
+			panic("handler bug")
+		}
+		create(w, r)
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic of the handler was swallowed")
+			}
+		}()
+		postThing(router, "key-1", `{"name":"a"}`)
+	}()
+	retry := postThing(router, "key-1", `{"name":"a"}`)
+
+	if retry.Code != http.StatusCreated || calls.Load() != 1 {
+		t.Errorf("retry after a panic = %d with %d handler runs, want %d with 1", retry.Code, calls.Load(), http.StatusCreated)
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/defilippomattia/gorest/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsRecordsRouteAndStatus(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Metrics)
+	router.Get("/api/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	router.Get("/api/metrics-test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	created := metrics.HTTPRequestsTotal.WithLabelValues(http.MethodGet, "/api/metrics-test/{id}", "201")
+	ok := metrics.HTTPRequestsTotal.WithLabelValues(http.MethodGet, "/api/metrics-test", "200")
+	unmatched := metrics.HTTPRequestsTotal.WithLabelValues(http.MethodGet, "unmatched", "404")
+	createdBefore := testutil.ToFloat64(created)
+	okBefore := testutil.ToFloat64(ok)
+	unmatchedBefore := testutil.ToFloat64(unmatched)
+
+	for _, path := range []string{"/api/metrics-test/1", "/api/metrics-test/2", "/api/metrics-test", "/api/does-not-exist"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := testutil.ToFloat64(created) - createdBefore; got != 2 {
+		t.Errorf("requests with route pattern and status 201 = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(ok) - okBefore; got != 1 {
+		t.Errorf("requests without explicit status counted as 200 = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(unmatched) - unmatchedBefore; got != 1 {
+		t.Errorf("unmatched requests = %v, want 1", got)
+	}
+}
+
+func TestMetricsObservesDuration(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Metrics)
+	router.Post("/api/metrics-duration-test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	//the observed latency varies, only the number of observations is compared
+	histogram := metrics.HTTPRequestDuration.WithLabelValues(http.MethodPost, "/api/metrics-duration-test", "204").(prometheus.Histogram)
+	before := histogramSampleCount(t, histogram)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/metrics-duration-test", nil))
+
+	if got := histogramSampleCount(t, histogram) - before; got != 1 {
+		t.Errorf("observed durations = %d, want 1", got)
+	}
+
+	lint, err := testutil.GatherAndLint(metrics.Registry, "gorest_http_request_duration_seconds", "gorest_http_requests_total")
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, problem := range lint {
+		t.Errorf("metric %s: %s", problem.Metric, problem.Text)
+	}
+}
+
+func histogramSampleCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	err := histogram.Write(&metric)
+	if err != nil {
+		t.Fatalf("reading histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
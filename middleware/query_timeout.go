@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// QueryTimeout puts a deadline on the request context so database calls made while handling
+// the request are cancelled once it passes. The deadline is looked up by "METHOD /route/pattern"
+// in perRoute, defaultTimeout is used for routes not listed there. A zero timeout disables the deadline.
+func QueryTimeout(routes chi.Routes, defaultTimeout time.Duration, perRoute map[string]time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := defaultTimeout
+
+			//the request is not routed yet, so resolve the route pattern up front
+			rctx := chi.NewRouteContext()
+			if routes.Match(rctx, r.Method, r.URL.Path) {
+				if routeTimeout, ok := perRoute[r.Method+" "+rctx.RoutePattern()]; ok {
+					timeout = routeTimeout
+				}
+			}
+
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/defilippomattia/gorest/ratelimit"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyUser   = "user"
+	RateLimitKeyAPIKey = "api_key"
+)
+
+type RateLimitPolicy struct {
+	ratelimit.Policy
+	// what the bucket is keyed by, one of RateLimitKeyIP, RateLimitKeyUser and RateLimitKeyAPIKey
+	KeyBy string
+}
+
+// RateLimit applies the policy of the route ("METHOD /route/pattern" in perRoute) or
+// defaultPolicy when the route has none, a nil defaultPolicy leaves such routes unlimited.
+// Requests over the limit get 429 with Retry-After, every limited response carries RateLimit-* headers.
+// It is mounted twice. Before Authenticate (beforeAuth) it applies the ip keyed policies, so
+// requests with guessed api keys or tokens are limited before Authenticate rejects them. Routes
+// whose own policy is keyed otherwise get an ip keyed defaultPolicy there. After Authenticate it
+// applies the policies keyed by user and api key.
+func RateLimit(routes chi.Routes, store ratelimit.Store, defaultPolicy *RateLimitPolicy, perRoute map[string]RateLimitPolicy, beforeAuth bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := defaultPolicy
+			bucketPrefix := "default"
+
+			rctx := chi.NewRouteContext()
+			if routes.Match(rctx, r.Method, r.URL.Path) {
+				route := r.Method + " " + rctx.RoutePattern()
+				if routePolicy, ok := perRoute[route]; ok {
+					policy = &routePolicy
+					bucketPrefix = route
+				}
+			}
+			if beforeAuth && policy != nil && policy.KeyBy != RateLimitKeyIP {
+				policy = defaultPolicy
+				bucketPrefix = "default"
+			}
+			if policy == nil || beforeAuth != (policy.KeyBy == RateLimitKeyIP) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := bucketPrefix + "|" + rateLimitKey(r, policy.KeyBy)
+			result, err := store.Take(r.Context(), key, policy.Policy)
+			if err != nil {
+				//fail open, an unavailable store should not take the whole api down
+				log.Ctx(r.Context()).Error().Err(err).Msg("error checking rate limit")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(result.Reset.Seconds())))
+			w.Header().Set("RateLimit-Policy", strconv.Itoa(policy.Requests)+";w="+strconv.Itoa(int(policy.Period.Seconds())))
+
+			if !result.Allowed {
+				log.Ctx(r.Context()).Warn().
+					Str("event", "http.rate_limited").
+					Str("bucket", bucketPrefix).
+					Str("key_by", policy.KeyBy).
+					Msg("rate limit exceeded")
+				w.Header().Set("Retry-After", strconv.Itoa(int(result.RetryAfter.Seconds())))
+				writeError(w, http.StatusTooManyRequests, "too many requests - retry later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey falls back to the client ip when the request has no user or api key.
+func rateLimitKey(r *http.Request, keyBy string) string {
+	switch keyBy {
+	case RateLimitKeyUser:
+		if userID := GetUserID(r.Context()); userID != -1 {
+			return "user:" + strconv.Itoa(userID)
+		}
+	case RateLimitKeyAPIKey:
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			//never keep raw keys around, not even in the bucket table
+			sum := sha256.Sum256([]byte(apiKey))
+			return "api_key:" + hex.EncodeToString(sum[:])
+		}
+	}
+	return "ip:" + ClientIP(r)
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/defilippomattia/gorest/ratelimit"
+	"github.com/go-chi/chi/v5"
+)
+
+type rejectingAPIKeys struct{}
+
+func (rejectingAPIKeys) ValidateAPIKey(ctx context.Context, apiKey string) (int, []string, error) {
+	return -1, nil, errors.New("unknown api key")
+}
+
+// newRateLimitedRouter mounts the limiter around Authenticate like main does.
+func newRateLimitedRouter(defaultPolicy *RateLimitPolicy, perRoute map[string]RateLimitPolicy) *chi.Mux {
+	router := chi.NewRouter()
+	store := ratelimit.NewMemoryStore()
+	router.Use(RateLimit(router, store, defaultPolicy, perRoute, true))
+	router.Use(Authenticate(Authenticators{APIKeys: rejectingAPIKeys{}}))
+	router.Use(RateLimit(router, store, defaultPolicy, perRoute, false))
+	router.Get("/api/things", func(w http.ResponseWriter, r *http.Request) {})
+	router.Get("/api/user-things", func(w http.ResponseWriter, r *http.Request) {})
+	return router
+}
+
+func rateLimitPolicyOf(requests int, keyBy string) RateLimitPolicy {
+	return RateLimitPolicy{Policy: ratelimit.Policy{Requests: requests, Period: time.Hour}, KeyBy: keyBy}
+}
+
+func getWithAPIKey(router http.Handler, path string, apiKey string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestRateLimitCountsRejectedCredentials(t *testing.T) {
+	for _, path := range []string{"/api/things", "/api/user-things"} {
+		t.Run(path, func(t *testing.T) {
+			defaultPolicy := rateLimitPolicyOf(2, RateLimitKeyIP)
+			router := newRateLimitedRouter(&defaultPolicy, map[string]RateLimitPolicy{
+				"GET /api/user-things": rateLimitPolicyOf(100, RateLimitKeyUser),
+			})
+			//every guess is a new key, the ip bucket still runs dry
+			for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+				if got := getWithAPIKey(router, path, "guess-"+strconv.Itoa(i)); got != want {
+					t.Errorf("guess %d = %d, want %d", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	defaultPolicy := rateLimitPolicyOf(2, RateLimitKeyIP)
+	router := newRateLimitedRouter(&defaultPolicy, map[string]RateLimitPolicy{
+		"GET /api/user-things": rateLimitPolicyOf(100, RateLimitKeyUser),
+	})
+	//anonymous requests of the user keyed route are limited by the default before and by their own policy after Authenticate
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := getWithAPIKey(router, "/api/user-things", ""); got != want {
+			t.Errorf("anonymous request %d = %d, want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestRateLimitRoutePolicyReplacesDefault(t *testing.T) {
+	defaultPolicy := rateLimitPolicyOf(1, RateLimitKeyIP)
+	router := newRateLimitedRouter(&defaultPolicy, map[string]RateLimitPolicy{
+		"GET /api/things": rateLimitPolicyOf(3, RateLimitKeyIP),
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := getWithAPIKey(router, "/api/things", ""); got != want {
+			t.Errorf("request %d = %d, want %d", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// incoming request ids are echoed back and written to logs, so only accept
+// short values made of safe characters and generate a new one otherwise
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+// RequestID accepts the X-Request-ID header from the client (or generates a new one),
+// sets it on the response and attaches a request scoped logger to the request context.
+// Code that handles the request should log with log.Ctx(ctx) so every line carries the request id.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := log.With().Str("request_id", requestID).Logger()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		ctx = logger.WithContext(ctx)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetRequestID returns the id of the request, or an empty string when the
+// RequestID middleware did not run.
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
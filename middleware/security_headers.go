@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the API only returns json, nothing in a response needs to load or frame anything
+const apiCSP = "default-src 'none'; frame-ancestors 'none'"
+
+type SecurityHeadersOptions struct {
+	// 0 leaves HSTS off, browsers only honour it on https responses
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	ReferrerPolicy        string
+	// path of the huma docs page and its CSP, the page loads its UI from a CDN
+	DocsPath string
+	DocsCSP  string
+}
+
+// SecurityHeaders sets the response headers that keep browsers from sniffing, framing or
+// leaking responses of the API.
+func SecurityHeaders(options SecurityHeadersOptions) func(http.Handler) http.Handler {
+	hsts := ""
+	if options.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(options.HSTSMaxAge.Seconds()))
+		if options.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hsts != "" {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("X-Frame-Options", "DENY")
+			w.Header().Set("Referrer-Policy", options.ReferrerPolicy)
+			if r.URL.Path == options.DocsPath {
+				w.Header().Set("Content-Security-Policy", options.DocsCSP)
+			} else {
+				w.Header().Set("Content-Security-Policy", apiCSP)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
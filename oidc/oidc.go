@@ -0,0 +1,381 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidIDToken = errors.New("id token is invalid")
+
+// allowed clock difference to the provider when checking exp and iat
+const clockSkew = time.Minute
+
+// an unknown kid refetches the key set at most this often, providers announce new keys
+// before signing with them
+const keySetRefreshInterval = time.Minute
+
+// algorithms of asymmetric keys, a symmetric or none alg in the token header is refused
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Claims are the parts of the ID token gorest uses.
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// Provider runs the authorization code flow with PKCE against one OpenID provider.
+// The endpoints are read from the discovery document on first use.
+type Provider struct {
+	issuerURL    string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	// signing keys by kid, fetched from jwks_uri
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewProvider requests the openid scope in addition to scopes. clientSecret may be empty
+// for public clients, PKCE protects the code exchange either way.
+func NewProvider(issuerURL string, clientID string, clientSecret string, redirectURL string, scopes []string) *Provider {
+	allScopes := []string{"openid"}
+	for _, scope := range scopes {
+		if scope != "openid" {
+			allScopes = append(allScopes, scope)
+		}
+	}
+	return &Provider{
+		issuerURL:    strings.TrimSuffix(issuerURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       allScopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// discover fetches the discovery document, a failed fetch is retried on the next login.
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuerURL+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc discoveryDocument
+	err = p.doJSON(req, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch discovery document: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.issuerURL {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, p.issuerURL)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document misses the authorization, token or jwks endpoint")
+	}
+
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// AuthCodeURL returns the url of the provider login page.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, codeVerifier string) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(doc.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	params := authURL.Query()
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("scope", strings.Join(p.scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+	authURL.RawQuery = params.Encode()
+	return authURL.String(), nil
+}
+
+// Exchange redeems the code at the token endpoint and returns the claims of the ID token
+// after checking its signature against the key set of the provider, iss, aud, exp, iat
+// and the nonce.
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*Claims, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.clientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	err = p.doJSON(req, &tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to exchange code: %w", err)
+	}
+	if tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("%w: token response has no id_token", ErrInvalidIDToken)
+	}
+
+	return p.validateIDToken(ctx, doc, tokenResp.IDToken, nonce)
+}
+
+func (p *Provider) validateIDToken(ctx context.Context, doc *discoveryDocument, idToken string, nonce string) (*Claims, error) {
+	var claims struct {
+		jwt.RegisteredClaims
+		Nonce             string `json:"nonce"`
+		AuthorizedParty   string `json:"azp"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(doc.Issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+	)
+	_, err := parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, doc, kid)
+	})
+	if err != nil {
+		//the provider being unreachable is not the fault of the token
+		var keySetErr *keySetError
+		if errors.As(err, &keySetErr) {
+			return nil, keySetErr.err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.clientID {
+		return nil, fmt.Errorf("%w: token is not meant for this client", ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidIDToken)
+	}
+
+	return &Claims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// keySetError wraps failures to fetch the key set so they are not taken for a bad token.
+type keySetError struct {
+	err error
+}
+
+func (e *keySetError) Error() string {
+	return e.err.Error()
+}
+
+// signingKey returns the key with kid, the only key when the token names none. Keys are
+// fetched on first use and again when the provider signs with a key not seen before.
+func (p *Provider) signingKey(ctx context.Context, doc *discoveryDocument, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.lookupKey(kid)
+	if ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < keySetRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, doc.JWKSURI, nil)
+	if err != nil {
+		return nil, &keySetError{err: err}
+	}
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = p.doJSON(req, &keySet)
+	if err != nil {
+		return nil, &keySetError{err: fmt.Errorf("unable to fetch signing keys: %w", err)}
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		//encryption keys and key types we do not know are skipped, not fatal
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		publicKey, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.ID] = publicKey
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	key, ok = p.lookupKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+func (p *Provider) doJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("provider answered %d: %s", resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// GenerateCodeVerifier returns a PKCE code verifier, it is also used for state and nonce.
+func GenerateCodeVerifier() (string, error) {
+	verifier := make([]byte, 32)
+	_, err := rand.Read(verifier)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(verifier), nil
+}
+
+func codeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "gorest"
+	testClientSecret = "gorest-secret"
+	testRedirectURL  = "http://gorest.test/api/auth/oidc/stub/callback"
+	testKeyID        = "stub-key"
+)
+
+// stubProvider is an OpenID provider serving discovery, authorize, token and jwks. The
+// authorize endpoint logs everyone in at once and remembers the PKCE challenge and nonce
+// of the code it hands out.
+type stubProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]stubGrant
+	// changes the claims of the next ID tokens, the defaults are valid
+	tamper func(claims jwt.MapClaims)
+	// signs the ID tokens, defaults to key with kid testKeyID
+	sign func(claims jwt.MapClaims) string
+}
+
+type stubGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	stub := &stubProvider{key: key, codes: make(map[string]stubGrant)}
+
+	router := chi.NewRouter()
+	router.Get("/.well-known/openid-configuration", stub.discovery)
+	router.Get("/authorize", stub.authorize)
+	router.Post("/token", stub.token)
+	router.Get("/jwks", stub.jwks)
+	stub.server = httptest.NewServer(router)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func (s *stubProvider) provider() *Provider {
+	return NewProvider(s.server.URL, testClientID, testClientSecret, testRedirectURL, []string{"email"})
+}
+
+func (s *stubProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 s.server.URL,
+		"authorization_endpoint": s.server.URL + "/authorize",
+		"token_endpoint":         s.server.URL + "/token",
+		"jwks_uri":               s.server.URL + "/jwks",
+	})
+}
+
+func (s *stubProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL ||
+		query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := GenerateCodeVerifier()
+	s.mu.Lock()
+	s.codes[code] = stubGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	s.mu.Unlock()
+
+	callback, _ := url.Parse(testRedirectURL)
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (s *stubProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || clientSecret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	grant, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL ||
+		codeChallenge(r.PostFormValue("code_verifier")) != grant.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                s.server.URL,
+		"sub":                "stub-user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              grant.nonce,
+		"email":              "stub@example.com",
+		"email_verified":     true,
+		"preferred_username": "stub",
+	}
+	if s.tamper != nil {
+		s.tamper(claims)
+	}
+	var idToken string
+	if s.sign != nil {
+		idToken = s.sign(claims)
+	} else {
+		idToken = signRS256(s.key, testKeyID, claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "stub-access-token", "token_type": "Bearer", "id_token": idToken})
+}
+
+func (s *stubProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": testKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// login runs the browser part of the flow and returns the code and state the provider
+// sent back to the callback.
+func login(t *testing.T, provider *Provider, state string, nonce string, codeVerifier string) (string, string) {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL(context.Background(), state, nonce, codeVerifier)
+	if err != nil {
+		t.Fatalf("building authorization url: %v", err)
+	}
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := browser.Get(authURL)
+	if err != nil {
+		t.Fatalf("opening authorization url: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization answered %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing callback url: %v", err)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func newLoginSecrets(t *testing.T) (string, string, string) {
+	t.Helper()
+	secrets := make([]string, 3)
+	for i := range secrets {
+		secret, err := GenerateCodeVerifier()
+		if err != nil {
+			t.Fatalf("generating secret: %v", err)
+		}
+		secrets[i] = secret
+	}
+	return secrets[0], secrets[1], secrets[2]
+}
+
+func TestLoginRoundTrip(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := stub.provider()
+	state, nonce, codeVerifier := newLoginSecrets(t)
+
+	code, returnedState := login(t, provider, state, nonce, codeVerifier)
+	if returnedState != state {
+		t.Errorf("callback state = %q, want %q", returnedState, state)
+	}
+
+	claims, err := provider.Exchange(context.Background(), code, codeVerifier, nonce)
+	if err != nil {
+		t.Fatalf("exchanging code: %v", err)
+	}
+	want := Claims{Subject: "stub-user-1", Email: "stub@example.com", EmailVerified: true, PreferredUsername: "stub"}
+	if *claims != want {
+		t.Errorf("claims = %+v, want %+v", *claims, want)
+	}
+
+	//codes are single use
+	_, err = provider.Exchange(context.Background(), code, codeVerifier, nonce)
+	if err == nil {
+		t.Error("exchanging a used code succeeded")
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := stub.provider()
+	state, nonce, codeVerifier := newLoginSecrets(t)
+	code, _ := login(t, provider, state, nonce, codeVerifier)
+
+	_, err := provider.Exchange(context.Background(), code, codeVerifier+"x", nonce)
+	if err == nil {
+		t.Fatal("exchanging with a wrong code verifier succeeded")
+	}
+	if errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("error = %v, the provider refusing the code is not an invalid id token", err)
+	}
+}
+
+func TestExchangeRejectsInvalidIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(claims jwt.MapClaims)
+		sign   func(claims jwt.MapClaims) string
+		nonce  string
+	}{
+		{name: "issuer", tamper: func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{name: "audience", tamper: func(claims jwt.MapClaims) { claims["aud"] = "other-client" }},
+		{name: "audiences without azp", tamper: func(claims jwt.MapClaims) { claims["aud"] = []string{testClientID, "other-client"} }},
+		{name: "expired", tamper: func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-2 * clockSkew).Unix() }},
+		{name: "missing exp", tamper: func(claims jwt.MapClaims) { delete(claims, "exp") }},
+		{name: "issued in the future", tamper: func(claims jwt.MapClaims) { claims["iat"] = time.Now().Add(2 * clockSkew).Unix() }},
+		{name: "missing subject", tamper: func(claims jwt.MapClaims) { delete(claims, "sub") }},
+		{name: "nonce", nonce: "other-nonce"},
+		{name: "unknown key", sign: func(claims jwt.MapClaims) string { return signRS256(otherKey, "other-key", claims) }},
+		{name: "forged signature", sign: func(claims jwt.MapClaims) string { return signRS256(otherKey, testKeyID, claims) }},
+		{name: "symmetric alg", sign: func(claims jwt.MapClaims) string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testClientSecret))
+			return signed
+		}},
+		{name: "alg none", sign: func(claims jwt.MapClaims) string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newStubProvider(t)
+			stub.tamper = test.tamper
+			stub.sign = test.sign
+			provider := stub.provider()
+			state, nonce, codeVerifier := newLoginSecrets(t)
+			code, _ := login(t, provider, state, nonce, codeVerifier)
+
+			expectedNonce := nonce
+			if test.nonce != "" {
+				expectedNonce = test.nonce
+			}
+			claims, err := provider.Exchange(context.Background(), code, codeVerifier, expectedNonce)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Exchange() = %+v, %v, want %v", claims, err, ErrInvalidIDToken)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsClockSkew(t *testing.T) {
+	stub := newStubProvider(t)
+	stub.tamper = func(claims jwt.MapClaims) {
+		claims["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+		claims["iat"] = time.Now().Add(clockSkew / 2).Unix()
+	}
+	provider := stub.provider()
+	state, nonce, codeVerifier := newLoginSecrets(t)
+	code, _ := login(t, provider, state, nonce, codeVerifier)
+
+	_, err := provider.Exchange(context.Background(), code, codeVerifier, nonce)
+	if err != nil {
+		t.Errorf("exchanging a token within the clock skew: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PgStore keeps buckets in the rate_limit_buckets table so limits hold across instances.
+type PgStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStore(db *pgxpool.Pool) *PgStore {
+	return &PgStore{db: db}
+}
+
+func (s *PgStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	now := time.Now()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	b := newBucket(policy, now)
+	args := pgx.NamedArgs{
+		"key":       key,
+		"tokens":    b.tokens,
+		"updatedAt": b.updatedAt,
+	}
+	//create the bucket if missing, then lock the row so concurrent instances take tokens one after another
+	_, err = tx.Exec(ctx, "INSERT INTO rate_limit_buckets (key, tokens, updated_at) VALUES (@key, @tokens, @updatedAt) ON CONFLICT (key) DO NOTHING", args)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to insert bucket: %w", err)
+	}
+	err = tx.QueryRow(ctx, "SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = @key FOR UPDATE", args).Scan(&b.tokens, &b.updatedAt)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to select bucket: %w", err)
+	}
+
+	result := b.take(policy, now)
+
+	args["tokens"] = b.tokens
+	args["updatedAt"] = b.updatedAt
+	_, err = tx.Exec(ctx, "UPDATE rate_limit_buckets SET tokens = @tokens, updated_at = @updatedAt WHERE key = @key", args)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to update bucket: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("unable to commit transaction: %w", err)
+	}
+	return result, nil
+}
+
+func (s *PgStore) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	args := pgx.NamedArgs{
+		"cutoff": time.Now().Add(-olderThan),
+	}
+	_, err := s.db.Exec(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < @cutoff", args)
+	if err != nil {
+		return fmt.Errorf("unable to delete idle buckets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Policy allows Requests per Period on average with bursts of up to Burst requests.
+type Policy struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+func (p Policy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Requests)
+}
+
+// rate is the number of tokens added to the bucket per second
+func (p Policy) rate() float64 {
+	return float64(p.Requests) / p.Period.Seconds()
+}
+
+// RefillTime is how long an empty bucket takes to fill up again.
+func (p Policy) RefillTime() time.Duration {
+	return time.Duration(p.capacity() / p.rate() * float64(time.Second))
+}
+
+// IdleCutoff is the longest refill time of the policies. Buckets idle for that long
+// are full under every policy, removing them gives clients nothing they would not have.
+func IdleCutoff(policies ...Policy) time.Duration {
+	var cutoff time.Duration
+	for _, policy := range policies {
+		cutoff = max(cutoff, policy.RefillTime())
+	}
+	return cutoff
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// time until the bucket is full again
+	Reset time.Duration
+	// time until the next request is allowed, zero when Allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets. Take refills the bucket of key according to the time
+// passed since the last call and consumes one token when available.
+type Store interface {
+	Take(ctx context.Context, key string, policy Policy) (Result, error)
+	// Cleanup removes buckets that were not used since olderThan, they would be full anyway
+	Cleanup(ctx context.Context, olderThan time.Duration) error
+}
+
+// bucket implements the token bucket algorithm shared by all stores.
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newBucket(policy Policy, now time.Time) bucket {
+	return bucket{tokens: policy.capacity(), updatedAt: now}
+}
+
+func (b *bucket) take(policy Policy, now time.Time) Result {
+	capacity := policy.capacity()
+	rate := policy.rate()
+
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+	}
+	b.updatedAt = now
+
+	result := Result{Limit: policy.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = seconds((capacity - b.tokens) / rate)
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+// RunCleanup periodically removes idle buckets from the store until ctx is done.
+func RunCleanup(ctx context.Context, store Store, interval time.Duration, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := store.Cleanup(ctx, olderThan)
+			if err != nil {
+				log.Error().Err(err).Msg("error cleaning up rate limit buckets")
+			}
+		}
+	}
+}
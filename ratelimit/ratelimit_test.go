@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketTakeAndRefill(t *testing.T) {
+	//10 requests per minute refill one token every 6 seconds, bursts of up to 3
+	policy := Policy{Requests: 10, Period: time.Minute, Burst: 3}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBucket(policy, start)
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  Result
+	}{
+		{name: "full bucket", after: 0, want: Result{Allowed: true, Limit: 10, Remaining: 2, Reset: 6 * time.Second}},
+		{name: "second of burst", after: 0, want: Result{Allowed: true, Limit: 10, Remaining: 1, Reset: 12 * time.Second}},
+		{name: "last of burst", after: 0, want: Result{Allowed: true, Limit: 10, Remaining: 0, Reset: 18 * time.Second}},
+		{name: "empty", after: 0, want: Result{Allowed: false, Limit: 10, Remaining: 0, Reset: 18 * time.Second, RetryAfter: 6 * time.Second}},
+		{name: "partly refilled", after: 3 * time.Second, want: Result{Allowed: false, Limit: 10, Remaining: 0, Reset: 15 * time.Second, RetryAfter: 3 * time.Second}},
+		{name: "one token refilled", after: 6 * time.Second, want: Result{Allowed: true, Limit: 10, Remaining: 0, Reset: 15 * time.Second}},
+		{name: "refill stops at burst", after: time.Hour, want: Result{Allowed: true, Limit: 10, Remaining: 2, Reset: 6 * time.Second}},
+	}
+	now := start
+	for _, test := range tests {
+		now = now.Add(test.after)
+		got := b.take(policy, now)
+		if got != test.want {
+			t.Errorf("%s: take() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBucketIgnoresClockGoingBack(t *testing.T) {
+	policy := Policy{Requests: 1, Period: time.Minute}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBucket(policy, start)
+
+	b.take(policy, start)
+	got := b.take(policy, start.Add(-time.Hour))
+	if got.Allowed {
+		t.Errorf("take() after the clock went back = %+v, want no refill", got)
+	}
+}
+
+func TestPolicyRefillTimeAndIdleCutoff(t *testing.T) {
+	burst := Policy{Requests: 10, Period: time.Minute, Burst: 30}
+	plain := Policy{Requests: 5, Period: time.Hour}
+
+	if got := burst.RefillTime(); got != 3*time.Minute {
+		t.Errorf("RefillTime() with burst = %v, want 3m", got)
+	}
+	if got := plain.RefillTime(); got != time.Hour {
+		t.Errorf("RefillTime() = %v, want 1h", got)
+	}
+	if got := IdleCutoff(burst, plain); got != time.Hour {
+		t.Errorf("IdleCutoff() = %v, want 1h", got)
+	}
+	if got := IdleCutoff(); got != 0 {
+		t.Errorf("IdleCutoff() without policies = %v, want 0", got)
+	}
+}
+
+func TestMemoryStoreKeepsBucketsApart(t *testing.T) {
+	store := NewMemoryStore()
+	policy := Policy{Requests: 2, Period: time.Hour}
+	ctx := context.Background()
+
+	for i, want := range []bool{true, true, false} {
+		result, err := store.Take(ctx, "ip:192.0.2.1", policy)
+		if err != nil {
+			t.Fatalf("Take() error = %v", err)
+		}
+		if result.Allowed != want {
+			t.Errorf("request %d allowed = %v, want %v", i+1, result.Allowed, want)
+		}
+	}
+	result, err := store.Take(ctx, "ip:192.0.2.2", policy)
+	if err != nil {
+		t.Fatalf("Take() error = %v", err)
+	}
+	if !result.Allowed {
+		t.Error("another key shares the empty bucket")
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	store := NewMemoryStore()
+	policy := Policy{Requests: 1, Period: time.Hour}
+	ctx := context.Background()
+
+	store.Take(ctx, "idle", policy)
+	store.Take(ctx, "busy", policy)
+	store.buckets["idle"].updatedAt = time.Now().Add(-2 * time.Hour)
+
+	err := store.Cleanup(ctx, policy.RefillTime())
+	if err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("idle bucket was kept")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Error("busy bucket was removed")
+	}
+	//the removed bucket comes back full
+	result, _ := store.Take(ctx, "idle", policy)
+	if !result.Allowed {
+		t.Error("bucket recreated after cleanup is not full")
+	}
+}
@@ -1,26 +1,202 @@
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) NOT NULL UNIQUE,
-    password VARCHAR(255) NOT NULL
+    password VARCHAR(255) NOT NULL,
+    -- optional, needed to reset the password
+    email VARCHAR(255),
+    -- set once the user opened the link of the verification mail
+    email_verified_at TIMESTAMPTZ,
+    -- there is no endpoint to grant admin, set it directly in the database
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE
 );
 
+-- only verified emails are unique, registering never reveals whether an email is taken.
+-- Unverified emails are claims, verifying the email releases the claims of other users
+CREATE UNIQUE INDEX users_email_idx ON users (LOWER(email)) WHERE email_verified_at IS NOT NULL;
+
 CREATE TABLE employees (
     id SERIAL PRIMARY KEY,                
     first_name VARCHAR(100) NOT NULL,     
     last_name VARCHAR(100) NOT NULL,      
-    email VARCHAR(255) NOT NULL UNIQUE,   
+    email VARCHAR(255) NOT NULL,   
     age INT,             
-    created_at TIMESTAMP DEFAULT NOW()    
+    created_at TIMESTAMP DEFAULT NOW(),
+    -- soft delete, the purge job removes the row once the retention passed
+    deleted_at TIMESTAMPTZ,
+    -- optimistic concurrency, every update bumps it and clients send it back in If-Match
+    version INT NOT NULL DEFAULT 1
 );
 
+-- soft deleted employees do not block their email
+CREATE UNIQUE INDEX employees_email_idx ON employees (email) WHERE deleted_at IS NULL;
+
+-- only the SHA-256 of the session token is stored, see auth.HashToken
 CREATE TABLE sessions (
-    token CHAR(36) PRIMARY KEY NOT NULL,
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
     user_id INT NOT NULL,
     created_at TIMESTAMP DEFAULT NOW(),
     last_used TIMESTAMP DEFAULT NOW(),
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- opaque refresh tokens of the token auth mode, stored as SHA-256 like session tokens.
+-- every rotation adds a row to the family of the first token, reuse of a used token revokes the family
+CREATE TABLE refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    family_id UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+-- api keys for machine to machine access, stored as SHA-256, prefix is kept to tell keys apart
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- password reset tokens sent by mail, stored as SHA-256 and usable once
+CREATE TABLE password_reset_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- email verification tokens, stored as SHA-256. email is the address the token was sent to,
+-- a token does not verify an address the user changed to afterwards
+CREATE TABLE email_verification_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- users linked to an OpenID Connect identity, subject is the sub claim of the provider
+CREATE TABLE oidc_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ,
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- OpenID Connect logins waiting for the callback of the provider, the state is stored as SHA-256
+CREATE TABLE oidc_login_states (
+    state_hash CHAR(64) PRIMARY KEY NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(128) NOT NULL,
+    link_user_id INT,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (link_user_id) REFERENCES users(id)
+);
+
+-- TOTP secret of a user, only used for login once enabled by confirming a first code.
+-- last_used_step rejects a code that was already used inside its validity window
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    confirmed_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- one time recovery codes, stored as SHA-256
+CREATE TABLE recovery_codes (
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- logins waiting for the second factor, the token is stored as SHA-256
+CREATE TABLE mfa_challenges (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    auth_mode VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- failed login tracking, scope is 'username' or 'ip'
+CREATE TABLE login_attempts (
+    scope VARCHAR(16) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+-- token buckets of the postgres rate limit store
+CREATE TABLE rate_limit_buckets (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- responses of POST requests sent with an Idempotency-Key, replayed to retries. Keys are
+-- scoped by user or client ip, rows without status belong to requests still in progress
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    -- sha256 of method, path and body, a key reused for another request is rejected
+    fingerprint CHAR(64) NOT NULL,
+    status INT,
+    header JSONB,
+    body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+-- who changed what, see the audit package. actor_user_id has no foreign key,
+-- events must outlive the users they mention
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    actor_user_id INT,
+    action VARCHAR(32) NOT NULL,
+    resource_type VARCHAR(32) NOT NULL,
+    resource_id VARCHAR(255) NOT NULL,
+    changes JSONB,
+    metadata JSONB,
+    request_id VARCHAR(128) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_resource_idx ON audit_events (resource_type, resource_id);
+CREATE INDEX audit_events_actor_user_id_idx ON audit_events (actor_user_id);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+
 CREATE TABLE books (
     id INT PRIMARY KEY,
     title VARCHAR(255) NOT NULL,
@@ -55,7 +231,11 @@ INSERT INTO books (id, title, author) VALUES
 CREATE TABLE companies (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    year_founded INT
+    year_founded INT,
+    -- soft delete, the purge job removes the row once the retention passed
+    deleted_at TIMESTAMPTZ,
+    -- optimistic concurrency, every update bumps it and clients send it back in If-Match
+    version INT NOT NULL DEFAULT 1
 );
 
 
@@ -64,4 +244,26 @@ INSERT INTO companies (name, year_founded) VALUES
     ('Green Solutions LLC', 2015),
     ('CloudSync Ltd', 2012),
     ('DataWorks Corp', 2008),
-    ('NextGen Software', 2020);
\ No newline at end of file
+    ('NextGen Software', 2020);
+
+-- companies are created after employees, so the reference is added here. Deleting a company
+-- with employees is restricted, the API soft deletes and moves employees on request
+ALTER TABLE employees ADD COLUMN company_id INT REFERENCES companies(id) ON DELETE RESTRICT;
+
+CREATE INDEX employees_company_id_idx ON employees (company_id);
+
+CREATE TABLE departments (
+    id SERIAL PRIMARY KEY,
+    company_id INT NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (company_id, name)
+);
+
+-- the API keeps managers and departments within the employee's company and managers free of cycles
+ALTER TABLE employees
+    ADD COLUMN department_id INT REFERENCES departments(id) ON DELETE SET NULL,
+    ADD COLUMN manager_id INT REFERENCES employees(id) ON DELETE SET NULL;
+
+CREATE INDEX employees_department_id_idx ON employees (department_id);
+CREATE INDEX employees_manager_id_idx ON employees (manager_id);
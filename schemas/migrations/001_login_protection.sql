@@ -0,0 +1,16 @@
+-- Admins and failed login tracking. Existing users are no admins, grant it directly
+-- in the database.
+BEGIN;
+
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE login_attempts (
+    scope VARCHAR(16) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- Token buckets of the postgres rate limit store, they start full.
+BEGIN;
+
+CREATE TABLE rate_limit_buckets (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Sessions used to store the raw token in a CHAR(36) column. The old tokens are
+-- UUIDs, hashing them in place keeps existing sessions valid.
+BEGIN;
+
+ALTER TABLE sessions ALTER COLUMN token TYPE CHAR(64);
+UPDATE sessions SET token = encode(sha256(convert_to(trim(token), 'UTF8')), 'hex');
+ALTER TABLE sessions RENAME COLUMN token TO token_hash;
+
+COMMIT;
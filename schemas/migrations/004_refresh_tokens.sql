@@ -0,0 +1,17 @@
+-- Refresh tokens of the token auth mode, existing sessions are not affected.
+BEGIN;
+
+CREATE TABLE refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    family_id UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+COMMIT;
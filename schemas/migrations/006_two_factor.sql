@@ -0,0 +1,31 @@
+-- TOTP two-factor authentication. Existing users have it disabled until they enroll.
+BEGIN;
+
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    confirmed_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE recovery_codes (
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE mfa_challenges (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    auth_mode VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+COMMIT;
@@ -0,0 +1,17 @@
+-- Password resets are mailed, users get an optional email. Existing users have none
+-- and can not reset their password until they set one.
+BEGIN;
+
+ALTER TABLE users ADD COLUMN email VARCHAR(255);
+CREATE UNIQUE INDEX users_email_idx ON users (LOWER(email));
+
+CREATE TABLE password_reset_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+COMMIT;
@@ -0,0 +1,21 @@
+-- Emails of existing users stay unverified, with email_verification.required they have
+-- to verify them through /api/users/verify/resend before they can log in again. Only
+-- verified emails are unique from now on, unverified ones are claims.
+BEGIN;
+
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+DROP INDEX users_email_idx;
+CREATE UNIQUE INDEX users_email_idx ON users (LOWER(email)) WHERE email_verified_at IS NOT NULL;
+
+CREATE TABLE email_verification_tokens (
+    token_hash CHAR(64) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+COMMIT;
@@ -0,0 +1,25 @@
+-- OpenID Connect login, existing users link their identities by starting a login while logged in.
+BEGIN;
+
+CREATE TABLE oidc_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ,
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE oidc_login_states (
+    state_hash CHAR(64) PRIMARY KEY NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(128) NOT NULL,
+    link_user_id INT,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (link_user_id) REFERENCES users(id)
+);
+
+COMMIT;
@@ -0,0 +1,21 @@
+-- Audit log of data changes and auth events, it starts empty.
+BEGIN;
+
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    actor_user_id INT,
+    action VARCHAR(32) NOT NULL,
+    resource_type VARCHAR(32) NOT NULL,
+    resource_id VARCHAR(255) NOT NULL,
+    changes JSONB,
+    metadata JSONB,
+    request_id VARCHAR(128) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_resource_idx ON audit_events (resource_type, resource_id);
+CREATE INDEX audit_events_actor_user_id_idx ON audit_events (actor_user_id);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Soft delete of employees and companies. The unique constraint on the employee email
+-- becomes a partial index, soft deleted employees do not block their email.
+BEGIN;
+
+ALTER TABLE employees ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE companies ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE employees DROP CONSTRAINT employees_email_key;
+CREATE UNIQUE INDEX employees_email_idx ON employees (email) WHERE deleted_at IS NULL;
+
+COMMIT;
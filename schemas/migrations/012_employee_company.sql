@@ -0,0 +1,7 @@
+-- Employees belong to a company, existing employees start without one.
+BEGIN;
+
+ALTER TABLE employees ADD COLUMN company_id INT REFERENCES companies(id) ON DELETE RESTRICT;
+CREATE INDEX employees_company_id_idx ON employees (company_id);
+
+COMMIT;
@@ -0,0 +1,20 @@
+-- Departments and managers of employees, existing employees start in no department
+-- and without a manager.
+BEGIN;
+
+CREATE TABLE departments (
+    id SERIAL PRIMARY KEY,
+    company_id INT NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (company_id, name)
+);
+
+ALTER TABLE employees
+    ADD COLUMN department_id INT REFERENCES departments(id) ON DELETE SET NULL,
+    ADD COLUMN manager_id INT REFERENCES employees(id) ON DELETE SET NULL;
+
+CREATE INDEX employees_department_id_idx ON employees (department_id);
+CREATE INDEX employees_manager_id_idx ON employees (manager_id);
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Versions for ETags and If-Match, existing rows start at version 1.
+BEGIN;
+
+ALTER TABLE employees ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE companies ADD COLUMN version INT NOT NULL DEFAULT 1;
+
+COMMIT;